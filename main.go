@@ -17,16 +17,277 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/HuskarTang/go-stun/stun"
 )
 
 func main() {
-	var serverAddr = flag.String("s", stun.DefaultServerAddr, "STUN server address")
+	var serverAddr = flag.String("s", stun.DefaultServerAddr, "STUN server address or stun:/stuns: URI, a comma separated list runs a consensus")
+	var localAddr = flag.String("l", "", "local IP address to bind")
+	var localPort = flag.String("p", "", "local port or port range (e.g. 4000-4100) to bind")
+	var ifName = flag.String("i", "", "network interface to bind")
+	var srvDomain = flag.String("srv", "", "discover the STUN servers of a domain through DNS SRV records")
+	var fallbacks = flag.String("fallback", "", "comma separated servers compared with the first when it does not support CHANGE-REQUEST")
+	var layers = flag.Bool("layers", false, "count the NAT layers from the mappings the comma separated servers report")
+	var candidates = flag.Bool("candidates", false, "gather the ICE candidates against the comma separated servers and print them as SDP")
+	var monitor = flag.Duration("monitor", 0, "watch the mapping, probing at the given interval, and print the changes")
+	var failover = flag.Bool("failover", false, "use the comma separated servers as a failover list instead of a consensus")
+	var allIfs = flag.Bool("all", false, "run the detection on every usable interface")
+	var dual = flag.Bool("dual", false, "run the detection over IPv4 and IPv6 in parallel and look for a NAT64")
+	var transport = flag.String("t", "udp", "transport: udp, tcp or tls")
+	var alg = flag.Bool("alg", false, "look for a middlebox rewriting or stripping the content of the responses")
+	var behavior = flag.Bool("behavior", false, "run the RFC 5780 NAT behavior discovery")
+	var tcpBehavior = flag.Bool("tcp-behavior", false, "run the NAT behavior discovery over TCP (Linux), reported apart from UDP; the filtering needs a server connecting back on CHANGE-REQUEST, a non-standard extension, and is unknown otherwise")
+	var ports = flag.Int("ports", 0, "analyse the port allocation over the given number of mappings")
+	var ping = flag.Int("ping", 0, "send the given number of Binding requests like ping, -1 until interrupted")
+	var pingInterval = flag.Duration("ping-interval", time.Second, "interval between two ping requests")
+	var pingTimeout = flag.Duration("ping-timeout", 2*time.Second, "time after which a ping request is lost")
+	var mtu = flag.Bool("mtu", false, "probe the path MTU and whether fragmented datagrams pass, with PADDING")
+	var lifetime = flag.Duration("lifetime", 0, "measure the UDP mapping lifetime, up to the given bound")
 	flag.Parse()
 
-	client := stun.NewClient()
+	var opts []stun.ClientOption
+	trans := stun.TransportUDP
+	switch *transport {
+	case "udp":
+	case "tcp":
+		trans = stun.TransportTCP
+		opts = append(opts, stun.WithTransport(trans))
+	case "tls":
+		trans = stun.TransportTLS
+		opts = append(opts, stun.WithTransport(trans))
+	default:
+		fmt.Println("unsupported transport:", *transport)
+		return
+	}
+	if *localAddr != "" {
+		ip := net.ParseIP(*localAddr)
+		if ip == nil {
+			fmt.Println("invalid local IP address:", *localAddr)
+			return
+		}
+		opts = append(opts, stun.WithLocalIP(ip))
+	}
+	if *localPort != "" {
+		min, max, err := parsePortRange(*localPort)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts = append(opts, stun.WithLocalPortRange(min, max))
+	}
+	if *ifName != "" {
+		opts = append(opts, stun.WithInterface(*ifName))
+	}
+	if *fallbacks != "" {
+		opts = append(opts, stun.WithFallbackServers(strings.Split(*fallbacks, ",")...))
+	}
+
+	if *srvDomain != "" {
+		records, err := stun.LookupServers(context.Background(), *srvDomain, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var servers []string
+		added := make(map[string]bool)
+		for _, r := range records {
+			if r.Transport == trans && !added[r.DialAddr()] {
+				added[r.DialAddr()] = true
+				servers = append(servers, r.DialAddr())
+			}
+		}
+		if len(servers) == 0 {
+			fmt.Printf("no %v STUN server for %s\n", trans, *srvDomain)
+			return
+		}
+		*serverAddr = strings.Join(servers, ",")
+		*failover = true
+	}
+
+	if *allIfs {
+		results, err := stun.DiscoverInterfaces(*serverAddr, opts...)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				fmt.Printf("%s: %v\n", r.Interface, r.Err)
+				continue
+			}
+			fmt.Printf("%s: NAT Type: %v, local %v, mapped %v\n", r.Interface, r.NATType, r.LocalAddr, r.MappedAddr)
+		}
+		return
+	}
+
+	if *dual {
+		r, err := stun.DiscoverDualStack(*serverAddr, opts...)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(r)
+		return
+	}
+
+	if *candidates {
+		g := stun.NewGatherer(stun.GatherOptions{Servers: strings.Split(*serverAddr, ",")})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		gathering, err := g.Gather(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer gathering.Close()
+		for _, c := range gathering.Candidates {
+			fmt.Println(c.SDP())
+		}
+		return
+	}
+
+	if *monitor > 0 {
+		m := stun.NewMonitor(stun.MonitorOptions{Server: *serverAddr, Interval: *monitor}, opts...)
+		if err := m.Start(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		for e := range m.Events() {
+			fmt.Println(e.Time.Format(time.RFC3339), e)
+		}
+		return
+	}
+
+	if *layers {
+		l, err := stun.NewClient(opts...).DetectNATLayers(strings.Split(*serverAddr, ",")...)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(l)
+		return
+	}
+
+	if servers := strings.Split(*serverAddr, ","); len(servers) > 1 && !*failover {
+		cs, err := stun.DiscoverConsensus(servers, opts...)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(cs)
+		return
+	}
+
+	client := stun.NewClient(opts...)
+	defer client.Close()
+	if *failover {
+		list := stun.NewServerList(strings.Split(*serverAddr, ",")...)
+		nat, err := client.DiscoveryList(list)
+		for _, st := range list.Stats() {
+			fmt.Printf("%s: attempts %d, failures %d, rtt %v\n", st.Addr, st.Attempts, st.Failures, st.RTT)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Server:", client.Server())
+		fmt.Println("NAT Type:", nat)
+		fmt.Println(client)
+		return
+	}
+	if *ports > 0 {
+		a, err := client.AnalyzePorts(*serverAddr, *ports)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, sample := range a.Samples {
+			fmt.Printf("local %d -> mapped %d (%v)\n", sample.LocalPort, sample.MappedPort, sample.Dest)
+		}
+		fmt.Println(a)
+		return
+	}
+	if *ping != 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		stats, err := client.Ping(ctx, *serverAddr, stun.PingOptions{
+			Count:    *ping,
+			Interval: *pingInterval,
+			Timeout:  *pingTimeout,
+			OnReply: func(r stun.PingReply) {
+				fmt.Println(r)
+			},
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(stats)
+		return
+	}
+	if *mtu {
+		r, err := client.ProbeMTU(*serverAddr, stun.MTUOptions{})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(r)
+		return
+	}
+	if *lifetime > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		r, err := client.MeasureLifetime(ctx, *serverAddr, stun.LifetimeOptions{
+			Max: *lifetime,
+			Progress: func(idle time.Duration, alive bool) {
+				fmt.Printf("idle %v: mapping alive %v\n", idle, alive)
+			},
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Mapping lifetime:", r.Lifetime)
+		return
+	}
+	if *alg {
+		r, err := client.DetectALG(*serverAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(r)
+		return
+	}
+	if *tcpBehavior {
+		b, err := client.DiscoverTCPBehavior(*serverAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(b)
+		return
+	}
+	if *behavior {
+		b, err := client.DiscoverBehavior(*serverAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(b)
+		return
+	}
+
 	nat, err := client.Discovery(*serverAddr)
 	if err != nil {
 		fmt.Println(err)
@@ -36,3 +297,19 @@ func main() {
 	fmt.Println("NAT Type:", nat)
 	fmt.Println(client)
 }
+
+// parsePortRange parses "port" or "min-max".
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid local port: %s", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil || max < min {
+			return 0, 0, fmt.Errorf("invalid local port range: %s", s)
+		}
+	}
+	return min, max, nil
+}
@@ -0,0 +1,260 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressClass is the kind of range an IP address belongs to.
+type AddressClass int
+
+// Address classes.
+const (
+	AddressPublic AddressClass = iota
+	// AddressPrivate is RFC 1918 and the IPv6 unique local addresses.
+	AddressPrivate
+	// AddressShared is the RFC 6598 range of carrier-grade NATs.
+	AddressShared
+	AddressLoopback
+	AddressLinkLocal
+	// AddressSpecialUse is the other ranges of the IANA special-purpose
+	// registries: documentation, benchmarking, reserved, multicast...
+	AddressSpecialUse
+)
+
+var addressClassDescription = map[AddressClass]string{
+	AddressPublic:     "public",
+	AddressPrivate:    "private",
+	AddressShared:     "carrier-grade NAT shared",
+	AddressLoopback:   "loopback",
+	AddressLinkLocal:  "link-local",
+	AddressSpecialUse: "special-use",
+}
+
+func (a AddressClass) String() string {
+	if s, ok := addressClassDescription[a]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+var (
+	privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+	sharedNets  = mustParseCIDRs("100.64.0.0/10")
+	specialNets = mustParseCIDRs(
+		"0.0.0.0/8", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4",
+		"::/128", "100::/64", "2001:db8::/32")
+)
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyAddress tells the range of ip. IPv4-mapped IPv6 addresses are
+// classified as IPv4.
+func ClassifyAddress(ip net.IP) AddressClass {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	switch {
+	case ip.IsLoopback():
+		return AddressLoopback
+	case ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast():
+		return AddressLinkLocal
+	case inNets(ip, privateNets):
+		return AddressPrivate
+	case inNets(ip, sharedNets):
+		return AddressShared
+	case ip.IsMulticast() || inNets(ip, specialNets):
+		return AddressSpecialUse
+	}
+	return AddressPublic
+}
+
+// mappedIsLocal tells no NAT is between the client and the server: the
+// mapped address is the local port on one of the addresses of the host.
+func (c *Client) mappedIsLocal() bool {
+	if c.nMappedAddr == nil || c.nLocalAddr == nil || c.nMappedAddr.Port != c.nLocalAddr.Port {
+		return false
+	}
+	return isLocalAddress(c.nLocalAddr.String(), c.nMappedAddr.String())
+}
+
+// AddressProbe is the mapped address one server reported, and its range.
+type AddressProbe struct {
+	Server     *net.UDPAddr
+	MappedAddr *net.UDPAddr
+	Class      AddressClass
+	// Local tells the mapped address belongs to the host, no NAT is
+	// between the host and the server.
+	Local bool
+}
+
+// NATLayers is the count of NATs between the host and the farthest server,
+// found from the mapped addresses servers at different depths report.
+type NATLayers struct {
+	LocalAddr  *net.UDPAddr
+	LocalClass AddressClass
+	Probes     []AddressProbe
+	// Layers is the number of NATs seen, zero when every server saw a local
+	// address.
+	Layers int
+	// CGN tells a carrier-grade NAT is one of the layers, seen from a
+	// shared address range on the path.
+	CGN bool
+	// Notes are what the servers could not tell.
+	Notes []string
+}
+
+func (l *NATLayers) String() string {
+	s := fmt.Sprintf("NAT layers: %d, local address %v (%v)", l.Layers, l.LocalAddr, l.LocalClass)
+	if l.CGN {
+		s += ", carrier-grade NAT"
+	}
+	for _, p := range l.Probes {
+		s += fmt.Sprintf("\n  %v: mapped %v (%v)", p.Server, p.MappedAddr, p.Class)
+		if p.Local {
+			s += " local"
+		}
+	}
+	if len(l.Notes) > 0 {
+		s += "\n  " + strings.Join(l.Notes, "; ")
+	}
+	return s
+}
+
+/*
+ * each NAT on the path rewrites the source address, so a server between
+ * two NATs reports the address of the inner one: send a Binding-Request to
+ * every server from the same socket and count the distinct addresses of
+ * the ranges NATs hand out inside (private and shared), plus one for the
+ * outermost NAT when a server reports a public address.
+ */
+
+// DetectNATLayers asks every server for the mapping of one socket, and
+// counts the NATs on the way. The servers are host:port addresses or stun:
+// URIs. Servers inside the home or carrier network
+// (a router or a carrier STUN server) are needed to see the inner layers,
+// public servers only see the outermost one.
+func (c *Client) DetectNATLayers(servers ...string) (*NATLayers, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("NAT layers detection requires the UDP transport")
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no STUN server")
+	}
+	if err := c.prepare(servers[0]); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	if c.transport != TransportUDP {
+		return nil, errors.New("NAT layers detection requires the UDP transport")
+	}
+
+	fchk := func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	}
+	srvs := make([]*net.UDPAddr, 0, len(servers))
+	transactions := make([]*transaction, 0, len(servers))
+	for i, name := range servers {
+		// the others like fallbacks, in the family of the socket
+		srv := c.nSrvAddr
+		if i > 0 {
+			var err error
+			if srv, err = c.resolveFallback(name); err != nil {
+				return nil, err
+			}
+		}
+		srvs = append(srvs, srv)
+		transactions = append(transactions, c.agent.start(buildBindingRequestRFC5389(false, false), srv, fchk, nil))
+	}
+	var probes []AddressProbe
+	for i, t := range transactions {
+		reply, err := t.wait()
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			continue
+		}
+		mapped := reply.getReflexiveAddr()
+		probes = append(probes, AddressProbe{
+			Server:     srvs[i],
+			MappedAddr: mapped,
+			Class:      ClassifyAddress(mapped.IP),
+			Local: mapped.Port == c.nLocalAddr.Port &&
+				isLocalAddress(c.nLocalAddr.String(), mapped.String()),
+		})
+	}
+	if len(probes) == 0 {
+		return nil, errors.New("the STUN servers had NO answer")
+	}
+	return natLayers(c.nLocalAddr, probes), nil
+}
+
+func natLayers(local *net.UDPAddr, probes []AddressProbe) *NATLayers {
+	l := &NATLayers{LocalAddr: local, LocalClass: ClassifyAddress(local.IP), Probes: probes}
+	inner := make(map[string]bool)
+	public := false
+	for _, p := range probes {
+		if p.Local {
+			continue
+		}
+		switch p.Class {
+		case AddressPrivate, AddressShared:
+			inner[p.MappedAddr.IP.String()] = true
+			if p.Class == AddressShared {
+				l.CGN = true
+			}
+		default:
+			public = true
+		}
+	}
+	l.Layers = len(inner)
+	if public {
+		l.Layers++
+	}
+	if l.LocalClass == AddressShared {
+		// the host itself is numbered by the carrier
+		l.CGN = true
+	}
+	if public && len(inner) == 0 && l.LocalClass == AddressPrivate {
+		l.Notes = append(l.Notes, "NATs between the first one and the server are only seen by a server inside the carrier network")
+	}
+	return l
+}
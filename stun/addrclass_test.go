@@ -0,0 +1,105 @@
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassifyAddress(t *testing.T) {
+	cases := map[string]AddressClass{
+		"8.8.8.8":         AddressPublic,
+		"10.1.2.3":        AddressPrivate,
+		"172.31.255.1":    AddressPrivate,
+		"172.32.0.1":      AddressPublic,
+		"192.168.1.1":     AddressPrivate,
+		"100.64.0.1":      AddressShared,
+		"100.127.255.254": AddressShared,
+		"100.128.0.1":     AddressPublic,
+		"127.0.0.1":       AddressLoopback,
+		"169.254.1.1":     AddressLinkLocal,
+		"192.0.2.1":       AddressSpecialUse,
+		"240.0.0.1":       AddressSpecialUse,
+		"239.1.2.3":       AddressSpecialUse,
+		"::ffff:10.0.0.1": AddressPrivate,
+		"2001:4860::8888": AddressPublic,
+		"fd00::1":         AddressPrivate,
+		"fe80::1":         AddressLinkLocal,
+		"2001:db8::1":     AddressSpecialUse,
+		"::1":             AddressLoopback,
+	}
+	for s, class := range cases {
+		if got := ClassifyAddress(net.ParseIP(s)); got != class {
+			t.Errorf("%s classified %v, expect %v", s, got, class)
+		}
+	}
+}
+
+func TestNATLayers(t *testing.T) {
+	probe := func(mapped string, local bool) AddressProbe {
+		addr, _ := net.ResolveUDPAddr("udp", mapped)
+		return AddressProbe{MappedAddr: addr, Class: ClassifyAddress(addr.IP), Local: local}
+	}
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 4000}
+
+	// a router server sees the host, a carrier server the router's shared
+	// address, a public server the carrier NAT
+	l := natLayers(local, []AddressProbe{
+		probe("192.168.1.10:4000", true),
+		probe("100.72.1.2:5000", false),
+		probe("8.8.4.4:6000", false),
+	})
+	if l.Layers != 2 || !l.CGN {
+		t.Errorf("layers %d cgn %v, expect 2 layers with a CGN", l.Layers, l.CGN)
+	}
+
+	l = natLayers(local, []AddressProbe{probe("10.0.0.5:5000", false), probe("8.8.4.4:6000", false)})
+	if l.Layers != 2 || l.CGN {
+		t.Errorf("layers %d cgn %v, expect a double NAT without CGN", l.Layers, l.CGN)
+	}
+
+	l = natLayers(local, []AddressProbe{probe("8.8.4.4:6000", false), probe("8.8.4.5:6001", false)})
+	if l.Layers != 1 || len(l.Notes) == 0 {
+		t.Errorf("layers %d notes %v, expect one layer and a note", l.Layers, l.Notes)
+	}
+
+	l = natLayers(&net.UDPAddr{IP: net.IPv4(100, 64, 3, 4), Port: 4000}, []AddressProbe{probe("8.8.4.4:6000", false)})
+	if l.Layers != 1 || !l.CGN {
+		t.Errorf("layers %d cgn %v, expect the host numbered by a CGN", l.Layers, l.CGN)
+	}
+}
+
+func TestDetectNATLayers(t *testing.T) {
+	inside := newTestServer(t)
+	outside := newTestServer(t)
+	outside.setHandler(natResponse(7))
+
+	client := NewClient()
+	l, err := client.DetectNATLayers(inside.udpAddr(), outside.udpAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Probes) != 2 || !l.Probes[0].Local || l.Probes[1].Local || l.Layers != 1 {
+		t.Errorf("unexpected layers %v", l)
+	}
+}
+
+func TestDetectNATLayersResolve(t *testing.T) {
+	inside := newTestServer(t)
+	outside := newTestServer(t)
+	outside.setHandler(natResponse(7))
+	d := newTestDNS(t, nil, map[string]net.IP{"outside.example.test": net.IPv4(127, 0, 0, 1)})
+	_, port, _ := net.SplitHostPort(outside.udpAddr())
+
+	client := NewClient(WithResolver(d.resolver()))
+	l, err := client.DetectNATLayers("stun:"+inside.udpAddr(), "stun:outside.example.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Probes) != 2 || !l.Probes[0].Local || l.Probes[1].Local || l.Layers != 1 {
+		t.Errorf("unexpected layers %v", l)
+	}
+	// the UDP probes do not go to a stuns: server
+	if _, err := client.DetectNATLayers(inside.udpAddr(), "stuns:outside.example.test:"+port); err == nil {
+		t.Error("stuns: server probed over UDP")
+	}
+}
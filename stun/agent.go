@@ -0,0 +1,301 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// agent owns the read loop of a UDP socket and runs any number of
+// concurrent transactions on it, keyed by transaction ID. Messages which
+// are not responses are passed to the handler.
+type agent struct {
+	conn    net.PacketConn
+	handler func(p *packet)
+
+	// retransmission schedule, see start
+	rto      time.Duration
+	maxRto   time.Duration
+	maxSends int
+
+	mu           sync.Mutex
+	transactions map[string]*transaction
+	closed       bool
+	err          error
+	done         chan struct{}
+}
+
+// transaction is one outstanding request, it doubles as the future of the
+// response.
+type transaction struct {
+	agent    *agent
+	conn     net.PacketConn
+	id       string
+	data     []byte
+	addr     net.Addr
+	fchk     func(p *packet) bool
+	callback func(p *packet, err error)
+
+	sends   int
+	timeout time.Duration
+	timer   *time.Timer
+	// sent is the time of the last send, rtt the time from it to the
+	// response
+	sent time.Time
+	rtt  time.Duration
+
+	reply *packet
+	err   error
+	done  chan struct{}
+}
+
+func newAgent(conn net.PacketConn, handler func(p *packet)) *agent {
+	a := &agent{
+		conn:         conn,
+		handler:      handler,
+		rto:          defRetransmitIntervalMs * time.Millisecond,
+		maxRto:       maxTimeoutMs * time.Millisecond,
+		maxSends:     maxRetransmitNum,
+		transactions: make(map[string]*transaction),
+		done:         make(chan struct{}),
+	}
+	go a.readLoop()
+	return a
+}
+
+// RFC 3489: Clients SHOULD retransmit the request starting with an interval
+// of 100ms, doubling every retransmit until the interval reaches 1.6s.
+// Retransmissions continue with intervals of 1.6s until a response is
+// received, or a total of 9 requests have been sent.
+//
+// start sends rqst to addr and retransmits it on its own timer until a
+// response passing fchk arrives. The callback, when not nil, is called once
+// with the result; a transaction without any response ends with a nil packet
+// and a nil error.
+func (a *agent) start(rqst *packet, addr net.Addr, fchk func(p *packet) bool,
+	callback func(p *packet, err error)) *transaction {
+	return a.startFrom(a.conn, rqst, addr, fchk, callback)
+}
+
+// startFrom is start with the request sent from another socket, while the
+// response is still expected on the socket of the agent. This is how the
+// tests redirecting responses, like RESPONSE-PORT, are run.
+func (a *agent) startFrom(conn net.PacketConn, rqst *packet, addr net.Addr, fchk func(p *packet) bool,
+	callback func(p *packet, err error)) *transaction {
+	t := &transaction{
+		agent:    a,
+		conn:     conn,
+		id:       string(rqst.transID),
+		data:     rqst.serialize(),
+		addr:     addr,
+		fchk:     fchk,
+		callback: callback,
+		timeout:  a.rto,
+		done:     make(chan struct{}),
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		err := a.err
+		a.mu.Unlock()
+		t.complete(nil, err)
+		return t
+	}
+	a.transactions[t.id] = t
+	a.mu.Unlock()
+
+	t.send()
+	return t
+}
+
+// setMaxSends changes the number of sends of the transactions started from
+// now on, and of the outstanding ones.
+func (a *agent) setMaxSends(n int) {
+	a.mu.Lock()
+	a.maxSends = n
+	a.mu.Unlock()
+}
+
+// do runs a transaction and waits for its result.
+func (a *agent) do(rqst *packet, addr net.Addr, fchk func(p *packet) bool) (*packet, error) {
+	return a.start(rqst, addr, fchk, nil).wait()
+}
+
+// wait blocks until the transaction is finished.
+func (t *transaction) wait() (*packet, error) {
+	<-t.done
+	return t.reply, t.err
+}
+
+// roundTrip is the time from the last send to the response, zero without
+// one. A lost first send does not count in it.
+func (t *transaction) roundTrip() time.Duration {
+	<-t.done
+	return t.rtt
+}
+
+func (t *transaction) send() {
+	a := t.agent
+	a.mu.Lock()
+	t.sent = time.Now()
+	a.mu.Unlock()
+	if _, err := t.conn.WriteTo(t.data, t.addr); err != nil {
+		a.finish(t, nil, err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.transactions[t.id] != t {
+		return
+	}
+	t.sends++
+	wait := t.timeout
+	if t.timeout < a.maxRto {
+		t.timeout *= 2
+	}
+	t.timer = time.AfterFunc(wait, t.expire)
+}
+
+func (t *transaction) expire() {
+	a := t.agent
+	a.mu.Lock()
+	last := t.sends >= a.maxSends
+	a.mu.Unlock()
+	if last {
+		a.finish(t, nil, nil)
+		return
+	}
+	t.send()
+}
+
+func (t *transaction) complete(reply *packet, err error) {
+	t.reply, t.err = reply, err
+	close(t.done)
+	if t.callback != nil {
+		t.callback(reply, err)
+	}
+}
+
+// finish ends an outstanding transaction, it is a no-op if the transaction
+// already ended.
+func (a *agent) finish(t *transaction, reply *packet, err error) {
+	a.mu.Lock()
+	if a.transactions[t.id] != t {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.transactions, t.id)
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if reply != nil {
+		t.rtt = time.Since(t.sent)
+	}
+	a.mu.Unlock()
+
+	t.complete(reply, err)
+}
+
+func (a *agent) readLoop() {
+	defer close(a.done)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			a.mu.Lock()
+			closed := a.closed
+			a.mu.Unlock()
+			if closed {
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			a.shutdown(err)
+			return
+		}
+
+		// the packet keeps slices of its data, which must outlive buf
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		p, err := parsePackage(data)
+		if err != nil {
+			// not a STUN message, drop it
+			continue
+		}
+		p.orgHost = toUDPAddr(addr)
+		if isResponseType(p.types) {
+			a.handleResponse(p)
+		} else if a.handler != nil {
+			a.handler(p)
+		}
+	}
+}
+
+func (a *agent) handleResponse(p *packet) {
+	a.mu.Lock()
+	t := a.transactions[string(p.transID)]
+	a.mu.Unlock()
+	if t == nil {
+		// unknown, or a late duplicate of a finished transaction
+		return
+	}
+	if t.fchk != nil && !t.fchk(p) {
+		// this package not match this transaction
+		return
+	}
+	a.finish(t, p, nil)
+}
+
+// shutdown fails all outstanding transactions with err.
+func (a *agent) shutdown(err error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	a.err = err
+	pending := make([]*transaction, 0, len(a.transactions))
+	for _, t := range a.transactions {
+		pending = append(pending, t)
+	}
+	a.mu.Unlock()
+
+	for _, t := range pending {
+		a.finish(t, nil, err)
+	}
+}
+
+// close stops the read loop, the socket itself is left open. The read loop
+// is woken through the read deadline, which is cleared afterwards: a
+// deadline the owner of a shared socket had set is lost.
+func (a *agent) close() {
+	a.shutdown(net.ErrClosed)
+	// wake up the read loop
+	_ = a.conn.SetReadDeadline(time.Now())
+	<-a.done
+	_ = a.conn.SetReadDeadline(time.Time{})
+}
+
+// isResponseType tells success and error responses from requests and
+// indications by the class bits of the message type.
+func isResponseType(types uint16) bool {
+	return types&0x0100 != 0
+}
@@ -0,0 +1,96 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAgent(t *testing.T, handler func(p *packet)) *agent {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	a := newAgent(conn, handler)
+	a.rto = 10 * time.Millisecond
+	a.maxRto = 40 * time.Millisecond
+	t.Cleanup(func() {
+		a.close()
+		conn.Close()
+	})
+	return a
+}
+
+func TestAgentConcurrentTransactions(t *testing.T) {
+	srv := newTestServer(t)
+	a := newTestAgent(t, nil)
+	addr := srv.udp.LocalAddr()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	answered := 0
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		a.start(buildBindingRequest(false, false), addr, nil, func(p *packet, err error) {
+			defer wg.Done()
+			if err == nil && p != nil && p.getMappedAddr() != nil {
+				mu.Lock()
+				answered++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if answered != 32 {
+		t.Errorf("%d of 32 concurrent transactions answered", answered)
+	}
+}
+
+func TestAgentDuplicateResponse(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		resp := bindingResponse(req, from)
+		// answer twice, the second copy is a late duplicate
+		_, _ = srv.udp.WriteTo(resp.serialize(), from)
+		return resp
+	})
+	handled := make(chan *packet, 4)
+	a := newTestAgent(t, func(p *packet) {
+		handled <- p
+	})
+
+	reply, err := a.do(buildBindingRequest(false, false), srv.udp.LocalAddr(), nil)
+	if err != nil || reply == nil {
+		t.Fatalf("transaction error: %v", err)
+	}
+	select {
+	case p := <-handled:
+		t.Errorf("duplicate response passed to the handler: %x", p.transID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAgentRetransmitTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	received := 0
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		mu.Lock()
+		received++
+		mu.Unlock()
+		return nil
+	})
+	a := newTestAgent(t, nil)
+	a.maxSends = 4
+
+	reply, err := a.do(buildBindingRequest(false, false), srv.udp.LocalAddr(), nil)
+	if reply != nil || err != nil {
+		t.Errorf("unanswered transaction ended with %v, %v", reply, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received != 4 {
+		t.Errorf("request sent %d times, expect 4", received)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AlteredField is a field of a STUN message changed on the path.
+type AlteredField struct {
+	Field    string
+	Expected string
+	Got      string
+}
+
+func (f AlteredField) String() string {
+	return fmt.Sprintf("%s: expect %s, got %s", f.Field, f.Expected, f.Got)
+}
+
+// ALGReport is the outcome of DetectALG.
+type ALGReport struct {
+	LocalAddr *net.UDPAddr
+	// MappedAddr is the XOR-MAPPED-ADDRESS, which address rewriting ALGs do
+	// not recognize.
+	MappedAddr *net.UDPAddr
+	// PlainMappedAddr is the MAPPED-ADDRESS, in clear in the payload.
+	PlainMappedAddr *net.UDPAddr
+	// SourceAddr is the source of the response.
+	SourceAddr *net.UDPAddr
+	// OriginAddr is the source the server put in RESPONSE-ORIGIN, or
+	// SOURCE-ADDRESS.
+	OriginAddr *net.UDPAddr
+	// Detected tells a middlebox altered the messages, Altered lists how.
+	Detected bool
+	Altered  []AlteredField
+	// Notes are the oddities which are no evidence of an ALG on their own.
+	Notes []string
+}
+
+func (r *ALGReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ALG detected: %v\n", r.Detected)
+	fmt.Fprintf(&b, "Local address: %v\n", r.LocalAddr)
+	fmt.Fprintf(&b, "XOR-MAPPED-ADDRESS: %v\n", r.MappedAddr)
+	fmt.Fprintf(&b, "MAPPED-ADDRESS: %v\n", r.PlainMappedAddr)
+	fmt.Fprintf(&b, "Response source: %v, origin: %v", r.SourceAddr, r.OriginAddr)
+	for _, f := range r.Altered {
+		fmt.Fprintf(&b, "\nAltered %v", f)
+	}
+	for _, note := range r.Notes {
+		fmt.Fprintf(&b, "\nNote: %s", note)
+	}
+	return b.String()
+}
+
+/*
+ * An ALG rewrites the addresses it finds in the payloads of the protocols it
+ * knows, and sometimes in any UDP payload. STUN carries the mapped address
+ * twice: in clear in MAPPED-ADDRESS and obfuscated in XOR-MAPPED-ADDRESS,
+ * which RFC 5389 introduced precisely because of such ALGs. Both differ only
+ * when the clear one was rewritten. The response also carries its own
+ * source, in RESPONSE-ORIGIN or SOURCE-ADDRESS, to compare with the source
+ * seen, and a FINGERPRINT which any other change breaks.
+ *
+ * A rewriting on the way out is spotted by a request whose transaction ID
+ * embeds the local address: the server echoes the ID, rewritten or not, and
+ * a rewritten one matches no request.
+ */
+
+// DetectALG checks the responses of the server for the traces of a
+// middlebox rewriting or stripping their content.
+func (c *Client) DetectALG(srvAddrStr string) (*ALGReport, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("ALG detection requires the UDP transport")
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	rqst := buildBindingRequestRFC5389(false, false)
+	rqst.addFingerprint()
+	// no check of the response, a mangled one is what we look for
+	reply, err := c.agent.do(rqst, c.nSrvAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New("the STUN server had NO answer")
+	}
+	c.nMappedAddr = reply.getReflexiveAddr()
+
+	r := &ALGReport{
+		LocalAddr:       c.nLocalAddr,
+		MappedAddr:      reply.getXorMappedAddr(),
+		PlainMappedAddr: reply.getMappedAddr(),
+		SourceAddr:      reply.orgHost,
+		OriginAddr:      reply.findAttrAddr(attributeResponseOrigin),
+	}
+	if r.OriginAddr == nil {
+		r.OriginAddr = reply.getSourceAddr()
+	}
+	r.checkResponse(reply)
+
+	if c.nMappedAddr != nil && c.nLocalAddr.IP.To4() != nil && !addrEqual(c.nMappedAddr, c.nLocalAddr) {
+		answered, err := c.probeALGTransID()
+		if err != nil {
+			return r, err
+		}
+		if !answered {
+			r.alter("transaction ID", "echoed", "rewritten on the way out, no matching response")
+		}
+	}
+	return r, nil
+}
+
+// checkResponse compares the redundant fields of a response.
+func (r *ALGReport) checkResponse(reply *packet) {
+	if reply.findAttr(attributeFingerprint) != nil && !checkFingerprint(reply.raw) {
+		r.alter("FINGERPRINT", "valid", "mismatch, the payload was modified")
+	}
+	if r.MappedAddr != nil && r.PlainMappedAddr != nil && !addrEqual(r.MappedAddr, r.PlainMappedAddr) {
+		r.alter("MAPPED-ADDRESS", r.MappedAddr.String(), r.PlainMappedAddr.String())
+	}
+	// an RFC 3489 server has no XOR-MAPPED-ADDRESS, one sending the other
+	// RFC 5389 attributes has
+	if r.MappedAddr == nil && (reply.findAttr(attributeFingerprint) != nil ||
+		reply.findAttr(attributeResponseOrigin) != nil || reply.findAttr(attributeOtherAddress) != nil) {
+		r.alter("XOR-MAPPED-ADDRESS", "present", "stripped")
+	}
+	/*
+	 * a server behind a NAT of its own, or answering from another address
+	 * than the one it reports, gives another origin too: it is a rewriting
+	 * only along with the traces above
+	 */
+	if r.OriginAddr != nil && !addrEqual(r.OriginAddr, r.SourceAddr) {
+		if r.Detected {
+			r.alter("response origin", r.SourceAddr.String(), r.OriginAddr.String())
+		} else {
+			r.Notes = append(r.Notes, fmt.Sprintf("response from %v, the server reports %v as its origin",
+				r.SourceAddr, r.OriginAddr))
+		}
+	}
+}
+
+func (r *ALGReport) alter(field, expected, got string) {
+	r.Detected = true
+	r.Altered = append(r.Altered, AlteredField{Field: field, Expected: expected, Got: got})
+}
+
+// probeALGTransID sends a request whose transaction ID carries the local
+// address and port, and tells whether the response came back.
+func (c *Client) probeALGTransID() (bool, error) {
+	rqst := buildBindingRequestRFC5389(false, false)
+	copy(rqst.transID[4:8], c.nLocalAddr.IP.To4())
+	binary.BigEndian.PutUint16(rqst.transID[8:10], uint16(c.nLocalAddr.Port))
+	rqst.addFingerprint()
+	reply, err := c.agent.do(rqst, c.nSrvAddr, nil)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
@@ -0,0 +1,95 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// algResponse answers like an RFC 5780 server behind the test NAT, then
+// lets alter play the middlebox.
+func algResponse(srv *testServer, alter func(resp *packet, from *net.UDPAddr)) func(req *packet, from *net.UDPAddr) *packet {
+	return func(req *packet, from *net.UDPAddr) *packet {
+		if req.types != msgTypeBindingRequest {
+			return nil
+		}
+		mapped := &net.UDPAddr{IP: testNATIP, Port: from.Port}
+		resp, _ := newPacket()
+		resp.types = msgTypeBindingResponse
+		resp.transID = append([]byte(nil), req.transID...)
+		resp.addAttribute(*newAddrAttribute(attributeMappedAddress, mapped))
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, mapped, resp.transID))
+		resp.addAttribute(*newAddrAttribute(attributeResponseOrigin, toUDPAddr(srv.udp.LocalAddr())))
+		if alter != nil {
+			alter(resp, from)
+		}
+		return resp
+	}
+}
+
+func TestDetectALG(t *testing.T) {
+	srv := newTestServer(t)
+	fingerprint := func(resp *packet, from *net.UDPAddr) {
+		resp.addFingerprint()
+	}
+	cases := []struct {
+		name  string
+		alter func(resp *packet, from *net.UDPAddr)
+		field string
+		// how a response origin mismatch is reported: "note" or "altered"
+		origin string
+	}{
+		{"clean", fingerprint, "", ""},
+		{"rewritten MAPPED-ADDRESS", func(resp *packet, from *net.UDPAddr) {
+			resp.attributes[0] = *newAddrAttribute(attributeMappedAddress, from)
+			resp.addFingerprint()
+		}, "MAPPED-ADDRESS", ""},
+		{"stripped XOR-MAPPED-ADDRESS", func(resp *packet, from *net.UDPAddr) {
+			resp.attributes = append(resp.attributes[:1], resp.attributes[2:]...)
+			resp.addFingerprint()
+		}, "XOR-MAPPED-ADDRESS", ""},
+		{"payload changed after FINGERPRINT", func(resp *packet, from *net.UDPAddr) {
+			resp.addFingerprint()
+			resp.attributes[0] = *newAddrAttribute(attributeMappedAddress, &net.UDPAddr{IP: testNATIP, Port: 1})
+		}, "FINGERPRINT", ""},
+		{"server behind a NAT", func(resp *packet, from *net.UDPAddr) {
+			resp.attributes[2] = *newAddrAttribute(attributeResponseOrigin, &net.UDPAddr{IP: testNATIP, Port: 3478})
+		}, "", "note"},
+		{"rewritten MAPPED-ADDRESS and RESPONSE-ORIGIN", func(resp *packet, from *net.UDPAddr) {
+			resp.attributes[0] = *newAddrAttribute(attributeMappedAddress, from)
+			resp.attributes[2] = *newAddrAttribute(attributeResponseOrigin, &net.UDPAddr{IP: testNATIP, Port: 3478})
+		}, "MAPPED-ADDRESS", "altered"},
+		{"rewritten transaction ID", func(resp *packet, from *net.UDPAddr) {
+			// the local address in the ID turns into the mapped one
+			if i := bytes.Index(resp.transID, from.IP.To4()); i >= 0 {
+				copy(resp.transID[i:], testNATIP.To4())
+			}
+		}, "transaction ID", ""},
+	}
+	for _, tc := range cases {
+		srv.setHandler(algResponse(srv, tc.alter))
+		client := NewClient()
+		client.rto = 10 * time.Millisecond
+		client.maxSends = 3
+		r, err := client.DetectALG(srv.udpAddr())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (tc.origin == "note") != (len(r.Notes) > 0) {
+			t.Errorf("%s: notes %v", tc.name, r.Notes)
+		}
+		if tc.origin == "altered" && (len(r.Altered) == 0 || r.Altered[len(r.Altered)-1].Field != "response origin") {
+			t.Errorf("%s: altered %v, expect the response origin", tc.name, r.Altered)
+		}
+		if tc.field == "" {
+			if r.Detected {
+				t.Errorf("%s: ALG detected: %v", tc.name, r.Altered)
+			}
+			continue
+		}
+		if !r.Detected || len(r.Altered) == 0 || r.Altered[0].Field != tc.field {
+			t.Errorf("%s: altered %v, expect %s", tc.name, r.Altered, tc.field)
+		}
+	}
+}
@@ -17,7 +17,10 @@
 package stun
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
 	"encoding/binary"
+	"hash/crc32"
 	"net"
 )
 
@@ -65,6 +68,35 @@ const (
 	attributeReflectedFrom          = 0x000b
 )
 
+// attributes added by RFC 5389 and RFC 5780
+const (
+	attributeXorMappedAddress = 0x0020
+	attributePadding          = 0x0026
+	attributeResponsePort     = 0x0027
+	attributeResponseOrigin   = 0x802b
+	attributeOtherAddress     = 0x802c
+	attributeFingerprint      = 0x8028
+)
+
+// attributes added by ICE, RFC 8445
+const (
+	attributePriority       = 0x0024
+	attributeUseCandidate   = 0x0025
+	attributeIceControlled  = 0x8029
+	attributeIceControlling = 0x802a
+)
+
+// error codes of ERROR-CODE
+const (
+	errorCodeBadRequest   = 400
+	errorCodeUnauthorized = 401
+	errorCodeRoleConflict = 487
+)
+
+// RFC 5389: the FINGERPRINT value is the CRC-32 of the message up to the
+// attribute, XOR'ed with this constant.
+const fingerprintXOR = 0x5354554e
+
 const (
 	attributeFamilyIPv4 = 0x01
 	attributeFamilyIPV6 = 0x02
@@ -90,6 +122,14 @@ func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 }
 
 
+// newResponsePortAttribute asks an RFC 5780 server to send the response to
+// the source IP of the request and this port.
+func newResponsePortAttribute(port int) *attribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value[0:2], uint16(port))
+	return newAttribute(attributeResponsePort, value)
+}
+
 /*       0                   1                   2                   3
  *       0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
  *      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
@@ -101,8 +141,127 @@ func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
  *	    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
  */
 func (v *attribute) commAddr() *net.UDPAddr {
+	if len(v.value) < 8 {
+		return nil
+	}
 	addr := net.UDPAddr{}
 	addr.Port = int(binary.BigEndian.Uint16(v.value[2:4]))
 	addr.IP = v.value[4:v.length]
 	return &addr
 }
+
+// newAddrAttribute encodes addr in the MAPPED-ADDRESS format above.
+func newAddrAttribute(types uint16, addr *net.UDPAddr) *attribute {
+	family := attributeFamilyIPv4
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = attributeFamilyIPV6
+		ip = addr.IP.To16()
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = byte(family)
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:], ip)
+	return newAttribute(types, value)
+}
+
+// checkFingerprint verifies the FINGERPRINT attribute closing a serialized
+// message.
+func checkFingerprint(data []byte) bool {
+	if len(data) < 28 {
+		return false
+	}
+	attr := data[len(data)-8:]
+	if binary.BigEndian.Uint16(attr[0:2]) != attributeFingerprint || binary.BigEndian.Uint16(attr[2:4]) != 4 {
+		return false
+	}
+	crc := crc32.ChecksumIEEE(data[:len(data)-8]) ^ fingerprintXOR
+	return binary.BigEndian.Uint32(attr[4:8]) == crc
+}
+
+// xorAddr decodes an address attribute XOR'ed with the magic cookie and,
+// for IPv6, the transaction ID. transID is the 16 bytes following the
+// message length, the cookie included.
+func (v *attribute) xorAddr(transID []byte) *net.UDPAddr {
+	if len(transID) < 16 {
+		return nil
+	}
+	addr := v.commAddr()
+	if addr == nil {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(v.value[2:4]) ^ binary.BigEndian.Uint16(transID[0:2])
+	ip := make(net.IP, len(addr.IP))
+	for i := range ip {
+		ip[i] = addr.IP[i] ^ transID[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// newXorAddrAttribute encodes addr in the XOR-MAPPED-ADDRESS format.
+func newXorAddrAttribute(types uint16, addr *net.UDPAddr, transID []byte) *attribute {
+	att := newAddrAttribute(types, addr)
+	port := binary.BigEndian.Uint16(att.value[2:4]) ^ binary.BigEndian.Uint16(transID[0:2])
+	binary.BigEndian.PutUint16(att.value[2:4], port)
+	for i := 4; i < len(att.value); i++ {
+		att.value[i] ^= transID[i-4]
+	}
+	return att
+}
+
+// newTextAttribute encodes a text value such as USERNAME, whose length does
+// not count the padding.
+func newTextAttribute(types uint16, text string) *attribute {
+	att := newAttribute(types, []byte(text))
+	att.length = uint16(len(text))
+	return att
+}
+
+// newErrorCodeAttribute encodes an ERROR-CODE: the class (hundreds) and
+// number of the code, then the reason phrase.
+func newErrorCodeAttribute(code int, reason string) *attribute {
+	value := make([]byte, 4, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	value = append(value, reason...)
+	att := newAttribute(attributeErrorCode, value)
+	att.length = uint16(len(value))
+	return att
+}
+
+// errorCode decodes an ERROR-CODE attribute.
+func (v *attribute) errorCode() int {
+	if len(v.value) < 4 {
+		return 0
+	}
+	return int(v.value[2]&0x07)*100 + int(v.value[3])
+}
+
+// messageIntegrity is the HMAC-SHA1 of a message serialized with its length
+// covering the MESSAGE-INTEGRITY attribute which follows.
+func messageIntegrity(data []byte, key []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// checkMessageIntegrity verifies the MESSAGE-INTEGRITY attribute of a
+// serialized message, the attributes after it (FINGERPRINT) are not
+// covered.
+func checkMessageIntegrity(data []byte, key []byte) bool {
+	for pos := 20; pos+4 <= len(data); {
+		types := binary.BigEndian.Uint16(data[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if types == attributeMessageIntegrity {
+			if length != sha1.Size || pos+4+length > len(data) {
+				return false
+			}
+			covered := make([]byte, pos)
+			copy(covered, data[:pos])
+			binary.BigEndian.PutUint16(covered[2:4], uint16(pos-20+4+sha1.Size))
+			return hmac.Equal(messageIntegrity(covered, key), data[pos+4:pos+4+length])
+		}
+		pos += 4 + int(align(uint16(length)))
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// NATBehavior is the RFC 5780 classification of a NAT, which replaces the
+// cone/symmetric taxonomy of NATType.
+type NATBehavior struct {
+	Mapping   MappingBehavior
+	Filtering FilteringBehavior
+
+	LocalAddr  *net.UDPAddr
+	MappedAddr *net.UDPAddr
+	// OtherAddr is the alternate address of the server, from OTHER-ADDRESS
+	OtherAddr *net.UDPAddr
+	// Limited is the detection the mapping comes from when the server has
+	// no OTHER-ADDRESS, nil otherwise.
+	Limited *LimitedDetection
+}
+
+func (b *NATBehavior) String() string {
+	s := fmt.Sprintf("Mapping: %v\nFiltering: %v\nLocal address: %v\nMapped address: %v\nOther address: %v",
+		b.Mapping, b.Filtering, b.LocalAddr, b.MappedAddr, b.OtherAddr)
+	if b.Limited != nil {
+		s += "\n" + b.Limited.String()
+	}
+	return s
+}
+
+// buildBindingRequestRFC5389 builds a Binding-Request carrying the RFC 5389
+// magic cookie, which RFC 5780 servers answer with XOR-MAPPED-ADDRESS and
+// OTHER-ADDRESS.
+func buildBindingRequestRFC5389(changeIP bool, changePort bool) *packet {
+	pkt := buildBindingRequest(changeIP, changePort)
+	if pkt == nil {
+		return nil
+	}
+	binary.BigEndian.PutUint32(pkt.transID[:4], magicCookieRFC5389)
+	return pkt
+}
+
+// DiscoverBehavior runs the RFC 5780 mapping and filtering tests against a
+// server supporting OTHER-ADDRESS. Against other servers the mapping is
+// found by comparing the mappings the fallback servers report, see
+// WithFallbackServers, and the filtering stays unknown.
+func (c *Client) DiscoverBehavior(srvAddrStr string) (*NATBehavior, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("NAT behavior discovery requires the UDP transport")
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	c.behavior = &NATBehavior{LocalAddr: c.nLocalAddr}
+	c.limited = nil
+	if err := c.doBehaviorTest1(c.nSrvAddr); err != nil {
+		return c.behavior, err
+	}
+	if c.behavior.OtherAddr == nil {
+		// no RFC 5780 support, compare the mappings of other servers
+		if _, err := c.doDetectLimited(); err != nil {
+			return c.behavior, err
+		}
+		c.behavior.Mapping = c.limited.Mapping
+		c.behavior.Limited = c.limited
+		return c.behavior, nil
+	}
+	// the filtering tests only talk to the primary address, they go first
+	// so that the mapping tests can not open the filter for the alternate
+	// address in advance
+	if err := c.doFilteringTest(); err != nil {
+		return c.behavior, err
+	}
+	if err := c.doMappingTest(); err != nil {
+		return c.behavior, err
+	}
+	return c.behavior, nil
+}
+
+// Behavior returns the result of the last behavior discovery.
+func (c *Client) Behavior() *NATBehavior {
+	return c.behavior
+}
+
+/*
+ * RFC 5780 4.3 Test I: send a Binding-Request to the primary address,
+ * wait for a response with XOR-MAPPED-ADDRESS and OTHER-ADDRESS, the latter
+ * missing from servers without RFC 5780 support
+ */
+func (c *Client) doBehaviorTest1(srvAddr net.Addr) error {
+	pkg := buildBindingRequestRFC5389(false, false)
+	reply, err := c.agent.do(pkg, srvAddr, func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	})
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errors.New("the STUN server had NO answer")
+	}
+	c.behavior.MappedAddr = reply.getReflexiveAddr()
+	c.behavior.OtherAddr = reply.getAlternateAddr()
+	c.nMappedAddr = c.behavior.MappedAddr
+	return nil
+}
+
+/*
+ * RFC 5780 4.3: compare the mapped addresses seen by the primary address,
+ * by the alternate IP and primary port (Test II), and by the alternate IP
+ * and port (Test III). Test II and III run concurrently on the mapping.
+ */
+func (c *Client) doMappingTest() error {
+	b := c.behavior
+	if addrEqual(b.MappedAddr, b.LocalAddr) {
+		// no NAT at all, every destination sees the local address
+		b.Mapping = MappingEndpointIndependent
+		return nil
+	}
+
+	srv := c.nSrvAddr
+	fchk := func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	}
+	test2 := c.agent.start(buildBindingRequestRFC5389(false, false),
+		&net.UDPAddr{IP: b.OtherAddr.IP, Port: srv.Port}, fchk, nil)
+	test3 := c.agent.start(buildBindingRequestRFC5389(false, false), b.OtherAddr, fchk, nil)
+
+	reply2, err := test2.wait()
+	if err != nil {
+		return err
+	}
+	reply3, err := test3.wait()
+	if err != nil {
+		return err
+	}
+	if reply2 == nil {
+		return errors.New("the alternate address of the STUN server had NO answer")
+	}
+	if addrEqual(reply2.getReflexiveAddr(), b.MappedAddr) {
+		b.Mapping = MappingEndpointIndependent
+		return nil
+	}
+	if reply3 == nil {
+		return errors.New("the alternate address of the STUN server had NO answer")
+	}
+	if addrEqual(reply3.getReflexiveAddr(), reply2.getReflexiveAddr()) {
+		b.Mapping = MappingAddressDependent
+	} else {
+		b.Mapping = MappingAddressAndPortDependent
+	}
+	return nil
+}
+
+/*
+ * RFC 5780 4.4: send a Binding-Request to the primary address with
+ * Change-IP and Change-Port marked (Test II), and one with Change-Port only
+ * (Test III). Both run concurrently on the mapping.
+ */
+func (c *Client) doFilteringTest() error {
+	b := c.behavior
+	srv := c.nSrvAddr
+	alternate := b.OtherAddr
+	test2 := c.agent.start(buildBindingRequestRFC5389(true, true), srv, func(p *packet) bool {
+		return p.orgHost.IP.Equal(alternate.IP) && p.orgHost.Port == alternate.Port
+	}, nil)
+	test3 := c.agent.start(buildBindingRequestRFC5389(false, true), srv, func(p *packet) bool {
+		return p.orgHost.IP.Equal(srv.IP) && p.orgHost.Port == alternate.Port
+	}, nil)
+
+	reply2, err := test2.wait()
+	if err != nil {
+		return err
+	}
+	reply3, err := test3.wait()
+	if err != nil {
+		return err
+	}
+	switch {
+	case reply2 != nil:
+		b.Filtering = FilteringEndpointIndependent
+	case reply3 != nil:
+		b.Filtering = FilteringAddressDependent
+	default:
+		b.Filtering = FilteringAddressAndPortDependent
+	}
+	return nil
+}
+
+// addrEqual compares the IP and port of two addresses.
+func addrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,183 @@
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNAT emulates the behavior of a NAT in front of the client, applied by
+// a testServer5780 to its answers.
+type testNAT struct {
+	mapping   MappingBehavior
+	filtering FilteringBehavior
+
+	mu        sync.Mutex
+	contacted map[string]bool
+}
+
+var testNATIP = net.IPv4(192, 0, 2, 1)
+
+func (n *testNAT) mapped(from *net.UDPAddr, ip, port int) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: testNATIP, Port: from.Port}
+	switch n.mapping {
+	case MappingAddressDependent:
+		addr.Port += ip * 10
+	case MappingAddressAndPortDependent:
+		addr.Port += ip*10 + port
+	}
+	return addr
+}
+
+func (n *testNAT) outbound(ip, port int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.contacted == nil {
+		n.contacted = make(map[string]bool)
+	}
+	n.contacted[string([]byte{byte(ip), byte(port)})] = true
+	n.contacted[string([]byte{byte(ip)})] = true
+}
+
+func (n *testNAT) inbound(ip, port int) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch n.filtering {
+	case FilteringAddressDependent:
+		return n.contacted[string([]byte{byte(ip)})]
+	case FilteringAddressAndPortDependent:
+		return n.contacted[string([]byte{byte(ip), byte(port)})]
+	}
+	return true
+}
+
+// testServer5780 is an RFC 5780 server on 127.0.0.1 and 127.0.0.2, each IP
+// listening on the same two ports.
+type testServer5780 struct {
+	conns [2][2]net.PacketConn
+	nat   *testNAT
+}
+
+func newTestServer5780(t *testing.T, nat *testNAT) *testServer5780 {
+	s := &testServer5780{nat: nat}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	for p := 0; p < 2; p++ {
+		for attempt := 0; s.conns[1][p] == nil; attempt++ {
+			if attempt == 16 {
+				t.Skip("can not listen on loopback")
+			}
+			c0, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[0]})
+			if err != nil {
+				t.Skip("can not listen on loopback:", err)
+			}
+			c1, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[1], Port: c0.LocalAddr().(*net.UDPAddr).Port})
+			if err != nil {
+				c0.Close()
+				continue
+			}
+			s.conns[0][p], s.conns[1][p] = c0, c1
+		}
+	}
+	for i := 0; i < 2; i++ {
+		for p := 0; p < 2; p++ {
+			go s.serve(i, p)
+		}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < 2; i++ {
+			for p := 0; p < 2; p++ {
+				s.conns[i][p].Close()
+			}
+		}
+	})
+	return s
+}
+
+func (s *testServer5780) addr(ip, port int) *net.UDPAddr {
+	return s.conns[ip][port].LocalAddr().(*net.UDPAddr)
+}
+
+func (s *testServer5780) serve(ip, port int) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.conns[ip][port].ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := parsePackage(append([]byte(nil), buf[:n]...))
+		if err != nil || req.types != msgTypeBindingRequest {
+			continue
+		}
+		s.nat.outbound(ip, port)
+		rip, rport := ip, port
+		for _, attr := range req.attributes {
+			if attr.types == attributeChangeRequest && attr.length == 4 {
+				flags := binary.BigEndian.Uint32(attr.value)
+				if flags&0x04 != 0 {
+					rip = 1 - rip
+				}
+				if flags&0x02 != 0 {
+					rport = 1 - rport
+				}
+			}
+		}
+
+		if !s.nat.inbound(rip, rport) {
+			continue
+		}
+
+		resp, _ := newPacket()
+		resp.types = msgTypeBindingResponse
+		resp.transID = req.transID
+		mapped := s.nat.mapped(from.(*net.UDPAddr), ip, port)
+		resp.addAttribute(*newAddrAttribute(attributeMappedAddress, mapped))
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, mapped, req.transID))
+		resp.addAttribute(*newAddrAttribute(attributeOtherAddress, s.addr(1-ip, 1-port)))
+		resp.addAttribute(*newAddrAttribute(attributeChangedAddress, s.addr(1-ip, 1-port)))
+		resp.addAttribute(*newAddrAttribute(attributeResponseOrigin, s.addr(rip, rport)))
+		_, _ = s.conns[rip][rport].WriteTo(resp.serialize(), from)
+	}
+}
+
+func TestMappingBehavior(t *testing.T) {
+	for _, mapping := range []MappingBehavior{
+		MappingEndpointIndependent,
+		MappingAddressDependent,
+		MappingAddressAndPortDependent,
+	} {
+		srv := newTestServer5780(t, &testNAT{mapping: mapping})
+		client := NewClient()
+		b, err := client.DiscoverBehavior(srv.addr(0, 0).String())
+		if err != nil {
+			t.Errorf("%v: behavior discovery error: %v", mapping, err)
+			continue
+		}
+		if b.Mapping != mapping {
+			t.Errorf("mapping behavior %v, expect %v", b.Mapping, mapping)
+		}
+	}
+}
+
+func TestFilteringBehavior(t *testing.T) {
+	for _, filtering := range []FilteringBehavior{
+		FilteringEndpointIndependent,
+		FilteringAddressDependent,
+		FilteringAddressAndPortDependent,
+	} {
+		nat := &testNAT{mapping: MappingAddressAndPortDependent, filtering: filtering}
+		srv := newTestServer5780(t, nat)
+		client := NewClient()
+		client.rto = 10 * time.Millisecond
+		client.maxSends = 4
+		b, err := client.DiscoverBehavior(srv.addr(0, 0).String())
+		if err != nil {
+			t.Errorf("%v: behavior discovery error: %v", filtering, err)
+			continue
+		}
+		if b.Filtering != filtering || b.Mapping != nat.mapping {
+			t.Errorf("behavior %v / %v, expect %v / %v", b.Mapping, b.Filtering, nat.mapping, filtering)
+		}
+	}
+}
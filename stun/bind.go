@@ -0,0 +1,119 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// selectLocalAddr picks the local address used to reach srvAddr. A pinned
+// IP or interface wins, otherwise the kernel route to the server decides.
+func (c *Client) selectLocalAddr(srvAddr *net.UDPAddr) (*net.UDPAddr, error) {
+	if c.localIP != nil {
+		return &net.UDPAddr{IP: c.localIP}, nil
+	}
+	if c.ifName != "" {
+		ip, err := interfaceIP(c.ifName, srvAddr.IP.To4() == nil)
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip}, nil
+	}
+
+	conn, err := net.DialUDP("udp", nil, srvAddr)
+	if err != nil {
+		return nil, errors.New("fail to connect to STUN server:" + srvAddr.String())
+	}
+	defer conn.Close()
+	lcUdpAddr := conn.LocalAddr()
+	if lcUdpAddr == nil {
+		return nil, errors.New("runtime error")
+	}
+	return lcUdpAddr.(*net.UDPAddr), nil
+}
+
+// listenUDP opens the client socket on laddr, honouring the configured
+// port range and interface binding.
+func (c *Client) listenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: c.control}
+	if c.localPortMin <= 0 {
+		return lc.ListenPacket(context.Background(), "udp", laddr.String())
+	}
+
+	var lastErr error
+	for port := c.localPortMin; port <= c.localPortMax; port++ {
+		addr := net.JoinHostPort(laddr.IP.String(), strconv.Itoa(port))
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("empty local port range")
+	}
+	return nil, lastErr
+}
+
+// control is the raw socket hook applied to every socket the client opens.
+func (c *Client) control(network, address string, rc syscall.RawConn) error {
+	if c.ifName == "" {
+		return nil
+	}
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = bindToDevice(fd, c.ifName)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// interfaceIP returns the first global unicast address of the interface
+// in the requested family.
+func interfaceIP(name string, ipv6 bool) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ip := firstUsableIP(ifi, ipv6)
+	if ip == nil {
+		return nil, errors.New("no usable address on interface:" + name)
+	}
+	return ip, nil
+}
+
+func firstUsableIP(ifi *net.Interface, ipv6 bool) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if (ip.To4() == nil) == ipv6 {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package stun
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenUDPPortRange(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer busy.Close()
+	port := busy.LocalAddr().(*net.UDPAddr).Port
+
+	c := NewClient(WithLocalPortRange(port, port+10))
+	conn, err := c.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen in port range error: %v", err)
+	}
+	defer conn.Close()
+	got := conn.LocalAddr().(*net.UDPAddr).Port
+	if got <= port || got > port+10 {
+		t.Errorf("listen port %d out of range (%d, %d]", got, port, port+10)
+	}
+}
+
+func TestListenUDPPortRangeExhausted(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer busy.Close()
+	port := busy.LocalAddr().(*net.UDPAddr).Port
+
+	c := NewClient(WithLocalPort(port))
+	if conn, err := c.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err == nil {
+		conn.Close()
+		t.Errorf("listen on a busy port should fail")
+	}
+}
@@ -16,10 +16,12 @@
 package stun
 
 import (
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -29,13 +31,58 @@ type Client struct {
 	nChangedAddr *net.UDPAddr
 	nMappedAddr  *net.UDPAddr
 	conn         net.PacketConn
+	agent        *agent
+	behavior     *NATBehavior
+	hairpin      *Hairpin
+	evidence     *Evidence
+	limited      *LimitedDetection
+	fallbacks    []string
+	srvName      string
+	test1RTT     time.Duration
+	// retransmission schedule override of the agent, zero keeps RFC 3489
+	rto      time.Duration
+	maxSends int
+
+	// incoming requests awaited by a test, keyed by transaction ID
+	mu       sync.Mutex
+	incoming map[string]chan *packet
+
+	// local binding options, see options.go
+	localIP      net.IP
+	localPortMin int
+	localPortMax int
+	ifName       string
+	sharedConn   net.PacketConn
+
+	// server address family, see dualstack.go
+	family   IPFamily
+	resolver Resolver
+	// nat64 tells the server address is synthesized with a NAT64 prefix
+	nat64 bool
+	// routing table override of routable, for the tests
+	routes func(addr *net.UDPAddr) bool
+
+	// transport of the current call, set by prepare from the configured
+	// transportOpt and the server URI, and reset by release
+	transport    Transport
+	transportOpt Transport
+	streams      map[string]net.Conn
+	srvHost      string
+	tlsConfig    *tls.Config
+	// TLS options applied on top of tlsConfig, see tls.go
+	tlsRootCAs    *x509.CertPool
+	tlsServerName string
+	tlsCerts      []tls.Certificate
+	tlsPins       [][]byte
 }
 
 const (
 	maxRetransmitNum        = 9
 	defRetransmitIntervalMs = 100
 	maxTimeoutMs            = 1600
-	maxPacketSize           = 1024
+	// the largest UDP payload, so that padded and fragmented responses are
+	// not truncated
+	maxPacketSize = 65535
 )
 
 // callback function in testing, to check current response package is or not a expect package
@@ -54,59 +101,27 @@ func buildBindingRequest(changeIP bool, changePort bool) *packet {
 	return pkt
 }
 
-// RFC 3489: Clients SHOULD retransmit the request starting with an interval
-// of 100ms, doubling every retransmit until the interval reaches 1.6s.
-// Retransmissions continue with intervals of 1.6s until a response is
-// received, or a total of 9 requests have been sent.
+// fsmSendPackageWaitReply runs one transaction and waits for a response
+// passing fchk, see agent.start for the UDP retransmission rules. A nil
+// packet without error means the server did not answer.
 func (c *Client) fsmSendPackageWaitReply(rqst *packet, srvAddr net.Addr, fchk chkfun) (*packet, error) {
-	rqstPkgData := rqst.serialize()
-	conn := c.conn
-	timeout := defRetransmitIntervalMs
-	rcvPkgData := make([]byte, maxPacketSize)
-	for i := 0; i < maxRetransmitNum; i++ {
-		// Send packet to the server.
-		length, err := conn.WriteTo(rqstPkgData, srvAddr)
-		if err != nil {
-			return nil, err
-		}
-		if length != len(rqstPkgData) {
-			return nil, errors.New("error in sending rqstPkgData")
-		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
-		if err != nil {
-			return nil, err
-		}
-		if timeout < maxTimeoutMs {
-			timeout *= 2
-		}
+	reply, _, err := c.timedSendPackageWaitReply(rqst, srvAddr, fchk)
+	return reply, err
+}
 
-		for {
-			length, peerAddr, err := conn.ReadFrom(rcvPkgData)
-			if err != nil {
-				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-					break
-				}
-				return nil, err
-			}
-			p, err := parsePackage(rcvPkgData[0:length])
-			if err != nil {
-				return nil, err
-			}
-
-			// If transId mismatches, keep reading until get a
-			// matched packet or timeout.
-			if !bytes.Equal(rqst.transID, p.transID) {
-				continue
-			}
-			p.orgHost = peerAddr.(*net.UDPAddr)
-			if !fchk(c, p) {
-				// this package not match this testing
-				continue
-			}
-			return p, nil
-		}
+// timedSendPackageWaitReply is fsmSendPackageWaitReply which also returns
+// the round trip time, from the send answered over UDP.
+func (c *Client) timedSendPackageWaitReply(rqst *packet, srvAddr net.Addr, fchk chkfun) (*packet, time.Duration, error) {
+	if c.transport != TransportUDP {
+		start := time.Now()
+		reply, err := c.streamSendPackageWaitReply(rqst, srvAddr, fchk)
+		return reply, time.Since(start), err
 	}
-	return nil, nil
+	t := c.agent.start(rqst, srvAddr, func(p *packet) bool {
+		return fchk(c, p)
+	}, nil)
+	reply, err := t.wait()
+	return reply, t.roundTrip(), err
 }
 
 // Follow RFC 3489
@@ -155,15 +170,14 @@ func (c *Client) fsmSendPackageWaitReply(rqst *packet, srvAddr net.Addr, fchk ch
 
 /*
  * send a pure Binding-Request to SERVER I
- * wait for a response with MAPPED-ADDRESS and CHANGED-ADDRESS
+ * wait for a response with MAPPED-ADDRESS, CHANGED-ADDRESS is missing
+ * from the servers without CHANGE-REQUEST support
  */
 func (c *Client) doTest1(srvAddr net.Addr) (NATType, error) {
-	pkg := buildBindingRequest(false, false)
+	pkg := buildBindingRequestRFC5389(false, false)
 
 	fchk := func(cli *Client, pkg *packet) bool {
-		mappedAddr := pkg.getMappedAddr()
-		changedAddr := pkg.getChangedAddr()
-		if mappedAddr == nil || changedAddr == nil {
+		if pkg.getReflexiveAddr() == nil {
 			fmt.Println("test1 recv package, but check FAILED...")
 			return false
 		}
@@ -171,15 +185,21 @@ func (c *Client) doTest1(srvAddr net.Addr) (NATType, error) {
 		return true
 	}
 
-	reply, err := c.fsmSendPackageWaitReply(pkg, srvAddr, fchk)
+	// the RTT of the answered send, for the ranking of the servers
+	reply, rtt, err := c.timedSendPackageWaitReply(pkg, srvAddr, fchk)
 	if err != nil {
 		return NATTypeError, err
 	}
+	c.test1RTT = rtt
+	c.evidence.Test1 = outcome(reply != nil)
 	if reply == nil {
 		return NATTypeUdpBlocked, nil
 	}
-	c.nMappedAddr = reply.getMappedAddr()
-	c.nChangedAddr = reply.getChangedAddr()
+	c.nMappedAddr = reply.getReflexiveAddr()
+	c.nChangedAddr = reply.getAlternateAddr()
+	if c.nChangedAddr != nil && c.nChangedAddr.IP.Equal(c.nSrvAddr.IP) {
+		c.evidence.warn("CHANGED-ADDRESS has the IP of the server")
+	}
 	return NATTypeUnknown, nil // tobe continue
 }
 
@@ -195,6 +215,9 @@ func (c *Client) doTest2(srvAddr net.Addr) (NATType, error) {
 			fmt.Println("test2 recv package and check OK")
 			return true
 		}
+		if pkg.orgHost.String() == srvAddr.String() {
+			cli.setChangeIgnored(true)
+		}
 		fmt.Println("test2 recv package, but check FAILED...")
 		return false
 	}
@@ -203,8 +226,12 @@ func (c *Client) doTest2(srvAddr net.Addr) (NATType, error) {
 	if err != nil {
 		return NATTypeError, err
 	}
+	c.evidence.Test2 = outcome(reply != nil)
+	if reply == nil && c.changeIgnored() {
+		c.evidence.warn("CHANGE-REQUEST ignored, test II answered from the primary address")
+	}
 
-	hasPublicIP := c.nMappedAddr.String() == c.nLocalAddr.String()
+	hasPublicIP := c.mappedIsLocal()
 	if reply == nil {
 		// test1 show a MAPPED-ADDRESS same as LOCAL-ADDRESS, but can NOT receive packages from SERVER II
 		// So the station be behind a UDP Symmetric Firewall
@@ -233,7 +260,7 @@ func (c *Client) doTest3(srvAddr net.Addr) (NATType, error) {
 	pkg := buildBindingRequest(false, false)
 
 	fchk := func(cli *Client, pkg *packet) bool {
-		mappedAddr := pkg.getMappedAddr()
+		mappedAddr := pkg.getReflexiveAddr()
 		if mappedAddr == nil {
 			fmt.Println("test3 recv package, but check FAILED...")
 			return false
@@ -247,9 +274,12 @@ func (c *Client) doTest3(srvAddr net.Addr) (NATType, error) {
 		return NATTypeError, err
 	}
 	if reply == nil {
+		c.evidence.Test3 = TestFailed
+		c.evidence.warn("the CHANGED-ADDRESS of the server does not answer")
 		return NATTypeError, errors.New("the CHANGED server had NO answer")
 	}
-	nmapAddr := reply.getMappedAddr()
+	nmapAddr := reply.getReflexiveAddr()
+	c.evidence.Test3 = outcome(nmapAddr.String() == c.nMappedAddr.String())
 	if nmapAddr.String() != c.nMappedAddr.String() {
 		// the station connected to different SERVERS and got different MAPPED-ADDRESS
 		// so the station is on a Symmetric NAT network
@@ -272,14 +302,20 @@ func (c *Client) doTest4(srvAddr net.Addr) (NATType, error) {
 			fmt.Println("test4 recv package and check OK")
 			return true
 		}
+		cli.setChangeIgnored(true)
 		fmt.Println("test4 recv package, but check FAILED...")
 		return false
 	}
 
+	c.setChangeIgnored(false)
 	reply, err := c.fsmSendPackageWaitReply(pkg, srvAddr, fchk)
 	if err != nil {
 		return NATTypeError, err
 	}
+	c.evidence.Test4 = outcome(reply != nil)
+	if reply == nil && c.changeIgnored() {
+		c.evidence.warn("CHANGE-REQUEST ignored, test IV answered from the primary port")
+	}
 	if reply == nil {
 		return NATTypePortRestricted, nil
 	}
@@ -289,10 +325,22 @@ func (c *Client) doTest4(srvAddr net.Addr) (NATType, error) {
 }
 
 func (c *Client) doDetect() (nattyp NATType, err error) {
+	c.evidence = &Evidence{Server: c.nSrvAddr.String()}
+	defer func() {
+		c.evidence.NATType = nattyp
+		c.evidence.Err = err
+		c.evidence.MappedAddr = c.nMappedAddr
+		c.evidence.ChangedAddr = c.nChangedAddr
+	}()
+
 	nattyp, err = c.doTest1(c.nSrvAddr)
 	if err != nil || nattyp != NATTypeUnknown {
 		return nattyp, err
 	}
+	if c.nChangedAddr == nil {
+		// no CHANGE-REQUEST support, compare the mappings of other servers
+		return c.doDetectLimited()
+	}
 
 	nattyp, err = c.doTest2(c.nSrvAddr)
 	if err != nil || nattyp != NATTypeUnknown {
@@ -306,50 +354,202 @@ func (c *Client) doDetect() (nattyp NATType, err error) {
 	return c.doTest4(c.nSrvAddr)
 }
 
-func NewClient() *Client {
+func NewClient(opts ...ClientOption) *Client {
 	c := new(Client)
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
-func (c *Client) Discovery(srvAddrStr string) (NATType, error) {
-	if srvAddrStr == "" {
-		srvAddrStr = DefaultServerAddr
+// LocalAddr returns the local address used by the last discovery.
+func (c *Client) LocalAddr() *net.UDPAddr {
+	return c.nLocalAddr
+}
+
+// MappedAddr returns the MAPPED-ADDRESS learned by the last discovery.
+func (c *Client) MappedAddr() *net.UDPAddr {
+	return c.nMappedAddr
+}
+
+// Hairpin returns the hairpinning test result of the last discovery, nil
+// when the test did not run.
+func (c *Client) Hairpin() *Hairpin {
+	return c.hairpin
+}
+
+func (c *Client) String() string {
+	s := fmt.Sprintf("Local address: %v\nMapped address: %v\nChanged address: %v",
+		c.nLocalAddr, c.nMappedAddr, c.nChangedAddr)
+	if c.nMappedAddr != nil {
+		s += fmt.Sprintf("\nMapped address class: %v", ClassifyAddress(c.nMappedAddr.IP))
 	}
+	if c.limited != nil {
+		s += "\n" + c.limited.String()
+	}
+	if c.hairpin != nil {
+		s += "\nHairpinning: " + c.hairpin.String()
+	}
+	return s
+}
 
-	// 1, select local address
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", srvAddrStr)
-	if err != nil {
+func (c *Client) Discovery(srvAddrStr string) (NATType, error) {
+	if err := c.prepare(srvAddrStr); err != nil {
 		return NATTypeError, err
 	}
-	if serverUDPAddr == nil {
-		return NATTypeError, errors.New("cat resolve STUN server:" + srvAddrStr)
+	defer c.release()
+
+	if c.transport != TransportUDP {
+		// CHANGE-REQUEST can not be answered over a connection, the mapped
+		// address of the connection is all a stream transport tells
+		if _, err := c.doBinding(c.nSrvAddr); err != nil {
+			return NATTypeError, err
+		}
+		return NATTypeUnknown, nil
+	}
+
+	//3, do detect
+	c.hairpin = nil
+	c.limited = nil
+	nattyp, err := c.doDetect()
+	if err != nil || c.nMappedAddr == nil || c.mappedIsLocal() {
+		return nattyp, err
 	}
-	conn, err := net.DialUDP("udp", nil, serverUDPAddr)
-	if err != nil {
-		return NATTypeError, errors.New("fail to connect to STUN server:" + srvAddrStr)
+
+	//4, test hairpinning on the mapping of test I, its failure does not
+	// spoil the detection
+	if hairpin, err := c.doHairpinTest(); err == nil {
+		c.hairpin = hairpin
 	}
-	pkg := buildBindingRequest(false, false)
+	return nattyp, nil
+}
+
+// Binding sends a single Binding-Request over the configured transport and
+// returns the mapped address of the client.
+func (c *Client) Binding(srvAddrStr string) (*net.UDPAddr, error) {
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	return c.doBinding(c.nSrvAddr)
+}
+
+func (c *Client) doBinding(srvAddr net.Addr) (*net.UDPAddr, error) {
+	pkg := buildBindingRequestRFC5389(false, false)
 	if pkg == nil {
-		return NATTypeError, errors.New("runtime error")
+		return nil, errors.New("runtime error")
+	}
+	// an RFC 5389 server may send XOR-MAPPED-ADDRESS only
+	fchk := func(cli *Client, pkg *packet) bool {
+		return pkg.getReflexiveAddr() != nil
+	}
+
+	reply, err := c.fsmSendPackageWaitReply(pkg, srvAddr, fchk)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New("no response from STUN server:" + srvAddr.String())
 	}
-	_, _ = conn.Write(pkg.serialize())
-	lcUdpAddr := conn.LocalAddr()
-	if lcUdpAddr == nil {
-		return NATTypeError, errors.New("runtime error")
+	if conn, ok := c.streams[srvAddr.String()]; ok {
+		c.nLocalAddr = toUDPAddr(conn.LocalAddr())
+	}
+	c.nMappedAddr = reply.getReflexiveAddr()
+	return c.nMappedAddr, nil
+}
+
+// prepare resolves the server and, for UDP, opens the client socket. The
+// server is a host:port address or a stun: or stuns: URI, the latter
+// switching the client to the TLS transport.
+func (c *Client) prepare(srvAddrStr string) (err error) {
+	if srvAddrStr == "" {
+		srvAddrStr = DefaultServerAddr
+	}
+	c.srvName = srvAddrStr
+	c.transport = c.transportFor(srvAddrStr)
+	defer func() {
+		if err != nil {
+			c.transport = c.transportOpt
+		}
+	}()
+	if isURI(srvAddrStr) {
+		uri, err := ParseURI(srvAddrStr)
+		if err != nil {
+			return err
+		}
+		if !uri.Secure() && c.transport == TransportTLS {
+			return errors.New("stun: URI used with the TLS transport:" + srvAddrStr)
+		}
+		srvAddrStr = uri.Addr()
+	}
+	if host, _, err := net.SplitHostPort(srvAddrStr); err == nil {
+		c.srvHost = host
+	}
+
+	serverUDPAddr, err := c.resolveServer(srvAddrStr)
+	if err != nil {
+		return err
 	}
-	c.nLocalAddr = lcUdpAddr.(*net.UDPAddr)
 	c.nSrvAddr = serverUDPAddr
+	if c.transport != TransportUDP {
+		return nil
+	}
+	if c.sharedConn != nil {
+		c.conn = c.sharedConn
+		c.nLocalAddr = toUDPAddr(c.sharedConn.LocalAddr())
+		c.agent = c.newAgent(c.conn)
+		return nil
+	}
 
-	_ = conn.Close()
+	// 1, select local address
+	lcUdpAddr, err := c.selectLocalAddr(serverUDPAddr)
+	if err != nil {
+		return err
+	}
 
 	// 2, setup local UDP listen socket
-	conn, err = net.ListenUDP("udp", c.nLocalAddr)
+	conn, err := c.listenUDP(lcUdpAddr)
 	if err != nil {
-		return NATTypeError, err
+		return err
 	}
-	defer conn.Close()
 	c.conn = conn
+	c.nLocalAddr = conn.LocalAddr().(*net.UDPAddr)
+	c.agent = c.newAgent(c.conn)
+	return nil
+}
 
-	//3, do detect
-	return c.doDetect()
+func (c *Client) newAgent(conn net.PacketConn) *agent {
+	a := newAgent(conn, c.handleRequest)
+	if c.rto > 0 {
+		a.rto = c.rto
+	}
+	if c.maxSends > 0 {
+		a.maxSends = c.maxSends
+	}
+	return a
+}
+
+// transportFor is the transport of a call to srvAddrStr: TLS for a stuns:
+// URI, the configured one otherwise.
+func (c *Client) transportFor(srvAddrStr string) Transport {
+	if isURI(srvAddrStr) {
+		if uri, err := ParseURI(srvAddrStr); err == nil && uri.Secure() {
+			return TransportTLS
+		}
+	}
+	return c.transportOpt
+}
+
+// release closes the UDP socket opened by prepare.
+func (c *Client) release() {
+	c.transport = c.transportOpt
+	if c.agent != nil {
+		c.agent.close()
+		c.agent = nil
+	}
+	if c.conn != nil && c.conn != c.sharedConn {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
 }
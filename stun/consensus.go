@@ -0,0 +1,238 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TestOutcome is the outcome of one RFC 3489 test.
+type TestOutcome int
+
+// Test outcomes.
+const (
+	TestNotRun TestOutcome = iota
+	TestPassed
+	TestFailed
+)
+
+var testOutcomeDescription = map[TestOutcome]string{
+	TestNotRun: "not run",
+	TestPassed: "passed",
+	TestFailed: "failed",
+}
+
+func (o TestOutcome) String() string {
+	if s, ok := testOutcomeDescription[o]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+func outcome(passed bool) TestOutcome {
+	if passed {
+		return TestPassed
+	}
+	return TestFailed
+}
+
+// Evidence is what one server told during a discovery.
+type Evidence struct {
+	Server      string
+	NATType     NATType
+	Err         error
+	MappedAddr  *net.UDPAddr
+	ChangedAddr *net.UDPAddr
+
+	// Test1 passes on a response with MAPPED-ADDRESS.
+	Test1 TestOutcome
+	// Test2 passes on a response from the CHANGED-ADDRESS.
+	Test2 TestOutcome
+	// Test3 passes when the CHANGED-ADDRESS reports the same mapping.
+	Test3 TestOutcome
+	// Test4 passes on a response from the changed port.
+	Test4 TestOutcome
+
+	// Warnings are signs of a misbehaving server, seen during the tests.
+	Warnings []string
+	// Disagreements are the tests where the server disagrees with the
+	// majority of the servers.
+	Disagreements []string
+
+	// set from the read loop of the agent, under the client mutex
+	changeIgnored bool
+}
+
+func (e *Evidence) warn(s string) {
+	e.Warnings = append(e.Warnings, s)
+}
+
+// setChangeIgnored records whether a test with CHANGE-REQUEST was answered
+// from the unchanged address. The response checks run on the read loop of
+// the agent, hence the lock.
+func (c *Client) setChangeIgnored(ignored bool) {
+	c.mu.Lock()
+	c.evidence.changeIgnored = ignored
+	c.mu.Unlock()
+}
+
+func (c *Client) changeIgnored() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evidence.changeIgnored
+}
+
+// Suspect tells the server misbehaved or disagrees with the majority.
+func (e *Evidence) Suspect() bool {
+	return len(e.Warnings) > 0 || len(e.Disagreements) > 0
+}
+
+func (e *Evidence) tests() []TestOutcome {
+	return []TestOutcome{e.Test1, e.Test2, e.Test3, e.Test4}
+}
+
+// Consensus is the NAT type agreed on by a set of servers.
+type Consensus struct {
+	NATType NATType
+	// Confidence is the share of the answering servers voting for NATType.
+	Confidence float64
+	Evidence   []*Evidence
+}
+
+func (cs *Consensus) String() string {
+	s := fmt.Sprintf("NAT Type: %v, confidence %.2f", cs.NATType, cs.Confidence)
+	for _, e := range cs.Evidence {
+		s += fmt.Sprintf("\n  %s: %v", e.Server, e.NATType)
+		if e.Err != nil {
+			s += fmt.Sprintf(" (%v)", e.Err)
+		}
+		notes := append(append([]string{}, e.Warnings...), e.Disagreements...)
+		if len(notes) > 0 {
+			s += " [" + strings.Join(notes, "; ") + "]"
+		}
+	}
+	return s
+}
+
+// DiscoverConsensus runs a discovery against every server, in parallel and
+// each on its own socket, and returns the majority NAT type. Servers which
+// did not answer test I do not vote, servers with warnings only vote when
+// no well-behaved server answered.
+func DiscoverConsensus(servers []string, opts ...ClientOption) (*Consensus, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no STUN server")
+	}
+	evidence := make([]*Evidence, len(servers))
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := NewClient(opts...)
+			defer client.Close()
+			nat, err := client.Discovery(servers[i])
+			e := client.evidence
+			if e == nil {
+				// the discovery failed before the tests
+				e = &Evidence{NATType: nat, Err: err}
+			}
+			e.Server = servers[i]
+			evidence[i] = e
+		}(i)
+	}
+	wg.Wait()
+	return consensus(evidence), nil
+}
+
+// consensus votes on the NAT type, and flags the servers disagreeing with
+// the majority outcome of each test.
+func consensus(evidence []*Evidence) *Consensus {
+	cs := &Consensus{NATType: NATTypeUnknown, Evidence: evidence}
+
+	voters := make([]*Evidence, 0, len(evidence))
+	for _, e := range evidence {
+		if e.Err == nil && e.Test1 == TestPassed && len(e.Warnings) == 0 {
+			voters = append(voters, e)
+		}
+	}
+	if len(voters) == 0 {
+		for _, e := range evidence {
+			if e.Err == nil && e.Test1 == TestPassed {
+				voters = append(voters, e)
+			}
+		}
+	}
+	if len(voters) == 0 {
+		// nobody answered, unanimous UDP blocked is an answer too
+		for _, e := range evidence {
+			if e.Err == nil {
+				voters = append(voters, e)
+			}
+		}
+	}
+	if len(voters) == 0 {
+		cs.NATType = NATTypeError
+		return cs
+	}
+
+	votes := make(map[NATType]int)
+	best := 0
+	for _, e := range voters {
+		votes[e.NATType]++
+		// ties go to the server listed first
+		if votes[e.NATType] > best {
+			best = votes[e.NATType]
+			cs.NATType = e.NATType
+		}
+	}
+	cs.Confidence = float64(best) / float64(len(voters))
+
+	// per test majority among the voters which ran the test
+	for i := 0; i < 4; i++ {
+		count := make(map[TestOutcome]int)
+		for _, e := range voters {
+			if o := e.tests()[i]; o != TestNotRun {
+				count[o]++
+			}
+		}
+		majority := TestNotRun
+		if count[TestPassed] > count[TestFailed] {
+			majority = TestPassed
+		} else if count[TestFailed] > count[TestPassed] {
+			majority = TestFailed
+		}
+		if majority == TestNotRun {
+			continue
+		}
+		for _, e := range evidence {
+			if o := e.tests()[i]; o != TestNotRun && o != majority {
+				e.Disagreements = append(e.Disagreements,
+					fmt.Sprintf("test %d %v, the majority %v", i+1, o, majority))
+			}
+		}
+	}
+	for _, e := range evidence {
+		if e.NATType != cs.NATType && e.Err == nil && len(e.Disagreements) == 0 {
+			e.Disagreements = append(e.Disagreements,
+				fmt.Sprintf("%v, the majority %v", e.NATType, cs.NATType))
+		}
+	}
+	return cs
+}
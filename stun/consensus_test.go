@@ -0,0 +1,82 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsensus(t *testing.T) {
+	good := func(server string) *Evidence {
+		return &Evidence{Server: server, NATType: NATTypePortRestricted,
+			Test1: TestPassed, Test2: TestFailed, Test3: TestPassed, Test4: TestFailed}
+	}
+	// the server ignoring CHANGE-REQUEST claims test II through a bad
+	// CHANGED-ADDRESS and reports a full cone
+	liar := &Evidence{Server: "liar", NATType: NATTypeFullCone, Test1: TestPassed, Test2: TestPassed}
+	down := &Evidence{Server: "down", NATType: NATTypeUdpBlocked, Test1: TestFailed}
+
+	cs := consensus([]*Evidence{liar, good("a"), good("b"), down})
+	if cs.NATType != NATTypePortRestricted {
+		t.Errorf("consensus %v, expect %v", cs.NATType, NATTypePortRestricted)
+	}
+	if cs.Confidence < 0.66 || cs.Confidence > 0.67 {
+		t.Errorf("confidence %f, expect 2/3", cs.Confidence)
+	}
+	if !liar.Suspect() || len(liar.Disagreements) == 0 {
+		t.Errorf("the disagreeing server is not flagged")
+	}
+	if !down.Suspect() {
+		t.Errorf("the server without answer is not flagged")
+	}
+	for _, e := range cs.Evidence[1:3] {
+		if e.Suspect() {
+			t.Errorf("agreeing server %s flagged: %v", e.Server, e.Disagreements)
+		}
+	}
+}
+
+func TestConsensusWarnedServersDoNotVote(t *testing.T) {
+	warned := &Evidence{Server: "warned", NATType: NATTypeFullCone, Test1: TestPassed,
+		Warnings: []string{"CHANGED-ADDRESS has the IP of the server"}}
+	good := &Evidence{Server: "good", NATType: NATTypeSymmetric, Test1: TestPassed}
+	failed := &Evidence{Server: "failed", NATType: NATTypeError, Err: errors.New("no answer")}
+
+	cs := consensus([]*Evidence{warned, good, failed})
+	if cs.NATType != NATTypeSymmetric || cs.Confidence != 1 {
+		t.Errorf("consensus %v confidence %f, expect %v confidence 1", cs.NATType, cs.Confidence, NATTypeSymmetric)
+	}
+}
+
+func TestDiscoveryChangeRequestIgnored(t *testing.T) {
+	changed := newTestServer(t)
+	changed.setHandler(natResponse(0))
+	/*
+	 * the primary server advertises CHANGED-ADDRESS but answers every
+	 * request itself, CHANGE-REQUEST or not
+	 */
+	primary := newTestServer(t)
+	changedAddr := toUDPAddr(changed.udp.LocalAddr())
+	primary.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		resp := natResponse(0)(req, from)
+		if resp != nil {
+			resp.addAttribute(*newAddrAttribute(attributeChangedAddress, changedAddr))
+		}
+		return resp
+	})
+
+	client := NewClient()
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 3
+	nat, err := client.Discovery(primary.udpAddr())
+	if err != nil || nat != NATTypePortRestricted {
+		t.Fatalf("discovery got %v, %v, expect %v", nat, err, NATTypePortRestricted)
+	}
+	warnings := strings.Join(client.evidence.Warnings, "; ")
+	if !strings.Contains(warnings, "test II answered from the primary address") ||
+		!strings.Contains(warnings, "test IV answered from the primary port") {
+		t.Errorf("warnings %q", warnings)
+	}
+}
@@ -39,7 +39,54 @@ func (nat NATType) String() string {
 	return "Unknown"
 }
 
+// MappingBehavior is the NAT mapping behavior of RFC 4787, as discovered
+// by the tests of RFC 5780.
+type MappingBehavior int
 
+// Mapping behaviors.
+const (
+	MappingUnknown MappingBehavior = iota
+	MappingEndpointIndependent
+	MappingAddressDependent
+	MappingAddressAndPortDependent
+)
 
+var mappingBehaviorDescription = map[MappingBehavior]string{
+	MappingUnknown:                 "Mapping behavior indeterminacy",
+	MappingEndpointIndependent:     "Endpoint-Independent Mapping",
+	MappingAddressDependent:        "Address-Dependent Mapping",
+	MappingAddressAndPortDependent: "Address and Port-Dependent Mapping",
+}
 
+func (m MappingBehavior) String() string {
+	if s, ok := mappingBehaviorDescription[m]; ok {
+		return s
+	}
+	return "Unknown"
+}
 
+// FilteringBehavior is the NAT filtering behavior of RFC 4787, as
+// discovered by the tests of RFC 5780.
+type FilteringBehavior int
+
+// Filtering behaviors.
+const (
+	FilteringUnknown FilteringBehavior = iota
+	FilteringEndpointIndependent
+	FilteringAddressDependent
+	FilteringAddressAndPortDependent
+)
+
+var filteringBehaviorDescription = map[FilteringBehavior]string{
+	FilteringUnknown:                 "Filtering behavior indeterminacy",
+	FilteringEndpointIndependent:     "Endpoint-Independent Filtering",
+	FilteringAddressDependent:        "Address-Dependent Filtering",
+	FilteringAddressAndPortDependent: "Address and Port-Dependent Filtering",
+}
+
+func (f FilteringBehavior) String() string {
+	if s, ok := filteringBehaviorDescription[f]; ok {
+		return s
+	}
+	return "Unknown"
+}
@@ -0,0 +1,305 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPFamily restricts the addresses a client reaches the server at.
+type IPFamily int
+
+// IP families.
+const (
+	IPFamilyAny IPFamily = iota
+	IPFamilyIPv4
+	IPFamilyIPv6
+)
+
+var ipFamilyDescription = map[IPFamily]string{
+	IPFamilyAny:  "any",
+	IPFamilyIPv4: "IPv4",
+	IPFamilyIPv6: "IPv6",
+}
+
+func (f IPFamily) String() string {
+	if s, ok := ipFamilyDescription[f]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// WithIPFamily reaches the server over IPv4 or IPv6 only. Over IPv6, a
+// server with IPv4 addresses only is reached through the NAT64 prefix the
+// DNS64 advertises, or the well-known one on a host without IPv4 route.
+func WithIPFamily(f IPFamily) ClientOption {
+	return func(c *Client) {
+		c.family = f
+	}
+}
+
+// WithResolver resolves the server and the NAT64 prefix with r instead of
+// net.DefaultResolver.
+func WithResolver(r Resolver) ClientOption {
+	return func(c *Client) {
+		c.resolver = r
+	}
+}
+
+func (c *Client) lookupResolver() Resolver {
+	if c.resolver != nil {
+		return c.resolver
+	}
+	return net.DefaultResolver
+}
+
+/*
+ * the server address is the first one of the family the host has a route
+ * to, IPv4 before IPv6 like net.ResolveUDPAddr. On an IPv6-only host the
+ * IPv4 addresses are not routed, they are then synthesized with the NAT64
+ * prefix of the network, the well-known one when the DNS64 advertises none.
+ */
+
+// resolveServer resolves the host:port srvAddrStr for the client family.
+func (c *Client) resolveServer(srvAddrStr string) (*net.UDPAddr, error) {
+	family := c.family
+	if family == IPFamilyAny && c.localIP != nil {
+		family = ipFamilyOf(c.localIP)
+	}
+	addr, nat64, err := c.resolveFamily(srvAddrStr, family)
+	c.nat64 = nat64
+	return addr, err
+}
+
+// resolveFamily resolves the host:port srvAddrStr for family, and tells
+// whether the address is synthesized with a NAT64 prefix.
+func (c *Client) resolveFamily(srvAddrStr string, family IPFamily) (*net.UDPAddr, bool, error) {
+	host, portStr, err := net.SplitHostPort(srvAddrStr)
+	if err != nil {
+		return nil, false, err
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx := context.Background()
+
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else if addrs, err = c.lookupResolver().LookupIPAddr(ctx, host); err != nil {
+		return nil, false, err
+	}
+	var candidates, ipv4s []*net.UDPAddr
+	for _, want := range []IPFamily{IPFamilyIPv4, IPFamilyIPv6} {
+		for _, a := range addrs {
+			if ipFamilyOf(a.IP) != want {
+				continue
+			}
+			addr := &net.UDPAddr{IP: a.IP, Port: port, Zone: a.Zone}
+			if want == IPFamilyIPv4 {
+				ipv4s = append(ipv4s, addr)
+			}
+			if family == IPFamilyAny || family == want {
+				candidates = append(candidates, addr)
+			}
+		}
+	}
+	for _, addr := range candidates {
+		if c.routable(addr) {
+			return addr, false, nil
+		}
+	}
+
+	if family != IPFamilyIPv4 && len(ipv4s) > 0 {
+		prefixes, _ := DiscoverNAT64Prefixes(ctx, c.lookupResolver())
+		if len(prefixes) == 0 && !c.routableAny(ipv4s) {
+			prefixes = []*net.IPNet{WellKnownNAT64Prefix}
+		}
+		for _, prefix := range prefixes {
+			for _, addr := range ipv4s {
+				synth := &net.UDPAddr{IP: SynthesizeNAT64(prefix, addr.IP), Port: port}
+				if c.routable(synth) {
+					return synth, true, nil
+				}
+			}
+		}
+	}
+	if len(candidates) > 0 {
+		// no route at all, the socket setup reports it
+		return candidates[0], false, nil
+	}
+	return nil, false, errors.New("no " + family.String() + " address for STUN server:" + srvAddrStr)
+}
+
+// routable tells whether the host has a route to addr, from the pinned
+// local IP if any. No packet is sent.
+func (c *Client) routable(addr *net.UDPAddr) bool {
+	if c.routes != nil {
+		return c.routes(addr)
+	}
+	var laddr *net.UDPAddr
+	if c.localIP != nil {
+		laddr = &net.UDPAddr{IP: c.localIP}
+	}
+	conn, err := net.DialUDP("udp", laddr, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (c *Client) routableAny(addrs []*net.UDPAddr) bool {
+	for _, addr := range addrs {
+		if c.routable(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipFamilyOf(ip net.IP) IPFamily {
+	if ip.To4() != nil {
+		return IPFamilyIPv4
+	}
+	return IPFamilyIPv6
+}
+
+// FamilyResult is the outcome of the discovery over one IP family.
+type FamilyResult struct {
+	Family IPFamily
+	// Available tells the server has an address of the family the host
+	// has a route to, the discovery did not run otherwise.
+	Available  bool
+	ServerAddr *net.UDPAddr
+	LocalAddr  *net.UDPAddr
+	MappedAddr *net.UDPAddr
+	NATType    NATType
+	// NAT64 tells the server is reached through a NAT64: its address is
+	// synthesized, or it saw an IPv4 source for the IPv6 request.
+	NAT64 bool
+	Err   error
+}
+
+func (r *FamilyResult) String() string {
+	if !r.Available {
+		return fmt.Sprintf("%v: not available: %v", r.Family, r.Err)
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("%v: server %v: %v", r.Family, r.ServerAddr, r.Err)
+	}
+	s := fmt.Sprintf("%v: NAT Type: %v, server %v, local %v, mapped %v",
+		r.Family, r.NATType, r.ServerAddr, r.LocalAddr, r.MappedAddr)
+	if r.NAT64 {
+		s += " (through NAT64)"
+	}
+	return s
+}
+
+// DualStackResult holds the discoveries over IPv4 and IPv6.
+type DualStackResult struct {
+	IPv4 FamilyResult
+	IPv6 FamilyResult
+	// NAT64 tells the host reaches IPv4 through a NAT64, the DNS64
+	// advertises a prefix or the IPv6 discovery went through one.
+	NAT64 bool
+	// NAT64Prefixes are the prefixes the DNS64 advertises.
+	NAT64Prefixes []*net.IPNet
+}
+
+func (r *DualStackResult) String() string {
+	s := r.IPv4.String() + "\n" + r.IPv6.String()
+	if r.NAT64 {
+		s += "\nNAT64 detected"
+		if len(r.NAT64Prefixes) > 0 {
+			prefixes := make([]string, len(r.NAT64Prefixes))
+			for i, p := range r.NAT64Prefixes {
+				prefixes[i] = p.String()
+			}
+			s += ", DNS64 prefix " + strings.Join(prefixes, " ")
+		}
+	}
+	return s
+}
+
+// DiscoverDualStack runs the discovery over IPv4 and over IPv6 in parallel,
+// each where the host can reach the server over it, and looks for a NAT64
+// on the way. The options are applied to both clients, the family on top of
+// them.
+func DiscoverDualStack(srvAddrStr string, opts ...ClientOption) (*DualStackResult, error) {
+	if srvAddrStr == "" {
+		srvAddrStr = DefaultServerAddr
+	}
+	addrStr := srvAddrStr
+	if isURI(srvAddrStr) {
+		uri, err := ParseURI(srvAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		addrStr = uri.Addr()
+	}
+
+	result := &DualStackResult{}
+	results := []*FamilyResult{&result.IPv4, &result.IPv6}
+	var wg sync.WaitGroup
+	wg.Add(len(results) + 1)
+	go func() {
+		defer wg.Done()
+		result.NAT64Prefixes, _ = DiscoverNAT64Prefixes(context.Background(), NewClient(opts...).lookupResolver())
+	}()
+	for i, family := range []IPFamily{IPFamilyIPv4, IPFamilyIPv6} {
+		go func(r *FamilyResult, family IPFamily) {
+			defer wg.Done()
+			r.Family = family
+			client := NewClient(append(append([]ClientOption{}, opts...), WithIPFamily(family))...)
+			defer client.Close()
+			srvAddr, err := client.resolveServer(addrStr)
+			if err == nil && !client.routable(srvAddr) {
+				err = errors.New("no " + family.String() + " route to STUN server:" + srvAddr.String())
+			}
+			if err != nil {
+				r.Err = err
+				return
+			}
+			r.Available = true
+			r.NATType, r.Err = client.Discovery(srvAddrStr)
+			r.ServerAddr = client.nSrvAddr
+			r.LocalAddr = client.LocalAddr()
+			r.MappedAddr = client.MappedAddr()
+			r.NAT64 = client.nat64
+		}(results[i], family)
+	}
+	wg.Wait()
+
+	/*
+	 * the prefixes are known once both discoveries are done: an IPv6 server
+	 * address in one of them, or an IPv4 mapped address for an IPv6 request,
+	 * is a NAT64 on the way
+	 */
+	v6 := &result.IPv6
+	if v6.Available && v6.ServerAddr != nil {
+		v6.NAT64 = v6.NAT64 || IsNAT64Addr(v6.ServerAddr.IP, result.NAT64Prefixes) ||
+			(v6.MappedAddr != nil && v6.MappedAddr.IP.To4() != nil)
+	}
+	result.NAT64 = len(result.NAT64Prefixes) > 0 || v6.NAT64
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package stun
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestResolveServerFamily(t *testing.T) {
+	d := newTestDNS(t, nil, map[string]net.IP{"v4.example.test": net.IPv4(127, 0, 0, 1)})
+	addrStr := net.JoinHostPort("v4.example.test", strconv.Itoa(DefaultPort))
+
+	addr, err := NewClient(WithResolver(d.resolver())).resolveServer(addrStr)
+	if err != nil || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != DefaultPort {
+		t.Errorf("resolved %v, error %v", addr, err)
+	}
+	// no AAAA record and no DNS64 prefix to synthesize one
+	client := NewClient(WithResolver(d.resolver()), WithIPFamily(IPFamilyIPv6))
+	if addr, err = client.resolveServer(addrStr); err == nil {
+		t.Errorf("IPv6 address %v resolved", addr)
+	}
+}
+
+func TestResolveServerNAT64(t *testing.T) {
+	addrStr := net.JoinHostPort("v4.example.test", strconv.Itoa(DefaultPort))
+	serverIP := net.IPv4(192, 0, 2, 10)
+	// an IPv6-only host
+	ipv6Only := func(addr *net.UDPAddr) bool {
+		return addr.IP.To4() == nil
+	}
+	cases := []struct {
+		name  string
+		dns64 net.IP
+		want  net.IP
+	}{
+		{"DNS64 prefix", net.ParseIP("2001:db8:64::c000:aa"), net.ParseIP("2001:db8:64::c000:20a")},
+		{"well-known prefix", nil, net.ParseIP("64:ff9b::c000:20a")},
+	}
+	for _, tc := range cases {
+		a := map[string]net.IP{"v4.example.test": serverIP}
+		if tc.dns64 != nil {
+			a[ipv4OnlyName] = tc.dns64
+		}
+		d := newTestDNS(t, nil, a)
+		client := NewClient(WithResolver(d.resolver()))
+		client.routes = ipv6Only
+		addr, err := client.resolveServer(addrStr)
+		if err != nil || !addr.IP.Equal(tc.want) || addr.Port != DefaultPort || !client.nat64 {
+			t.Errorf("%s: resolved %v, NAT64 %v, error %v", tc.name, addr, client.nat64, err)
+		}
+	}
+}
+
+func TestDiscoverDualStack(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(natResponse(0))
+	d := newTestDNS(t, nil, nil)
+
+	r, err := DiscoverDualStack(srv.udpAddr(), WithResolver(d.resolver()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IPv4.Available || r.IPv4.Err != nil || r.IPv4.MappedAddr == nil || !r.IPv4.MappedAddr.IP.Equal(testNATIP) {
+		t.Errorf("IPv4 %v", &r.IPv4)
+	}
+	// the IPv4 literal has no IPv6 address without a NAT64
+	if r.IPv6.Available || r.IPv6.Err == nil {
+		t.Errorf("IPv6 %v", &r.IPv6)
+	}
+	if r.NAT64 || r.IPv4.NAT64 {
+		t.Errorf("NAT64 detected: %v", r)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatherOptions configures a Gatherer, zero values take the defaults.
+type GatherOptions struct {
+	// Servers are the STUN servers, host:port or stun: URIs, queried in
+	// parallel for the server reflexive candidates.
+	Servers []string
+	// IPs restricts the host candidates to these local addresses, by
+	// default every global unicast address of the interfaces which are up.
+	IPs []net.IP
+	// IPv6 adds the IPv6 addresses of the interfaces.
+	IPv6 bool
+	// Loopback adds the loopback interfaces.
+	Loopback bool
+	// Port binds the host sockets to a port, 0 picks one per socket.
+	Port int
+	// Component is the component id of the candidates, 1 by default.
+	Component int
+}
+
+// Gatherer lists the ICE candidates of the host.
+type Gatherer struct {
+	opts GatherOptions
+
+	// retransmission schedule override of the requests, zero keeps RFC 3489
+	rto      time.Duration
+	maxSends int
+}
+
+// Gathering is the outcome of a gathering: the candidates, and the host
+// sockets they were gathered on, which belong to the caller.
+type Gathering struct {
+	Candidates []*Candidate
+	Conns      []net.PacketConn
+}
+
+// NewGatherer creates a gatherer.
+func NewGatherer(opts GatherOptions) *Gatherer {
+	if opts.Component <= 0 {
+		opts.Component = 1
+	}
+	return &Gatherer{opts: opts}
+}
+
+// Gather binds a socket on every host address and asks the servers for the
+// mapped address of each. A server which does not answer before ctx is done
+// only misses its candidates.
+func (g *Gatherer) Gather(ctx context.Context) (*Gathering, error) {
+	ips := g.opts.IPs
+	if len(ips) == 0 {
+		var err error
+		if ips, err = hostIPs(g.opts.IPv6, g.opts.Loopback); err != nil {
+			return nil, err
+		}
+	}
+
+	gathering := &Gathering{}
+	for _, ip := range ips {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: g.opts.Port})
+		if err != nil {
+			continue
+		}
+		addr := toUDPAddr(conn.LocalAddr())
+		gathering.Conns = append(gathering.Conns, conn)
+		gathering.Candidates = append(gathering.Candidates, &Candidate{
+			Foundation: candidateFoundation(CandidateHost, addr.IP, ""),
+			Component:  g.opts.Component,
+			Priority:   CandidatePriority(CandidateHost, maxLocalPreference-len(gathering.Conns)+1, g.opts.Component),
+			Type:       CandidateHost,
+			Addr:       addr,
+			base:       conn,
+		})
+	}
+	if len(gathering.Conns) == 0 {
+		return nil, errors.New("no host address to gather candidates on")
+	}
+
+	hosts := append([]*Candidate(nil), gathering.Candidates...)
+	results := make([][]*Candidate, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *Candidate) {
+			defer wg.Done()
+			results[i] = g.reflexive(ctx, host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	for i, host := range hosts {
+		for _, c := range results[i] {
+			redundant := addrEqual(c.Addr, host.Addr)
+			for _, known := range gathering.Candidates {
+				redundant = redundant || (addrEqual(known.Addr, c.Addr) && known.base == c.base)
+			}
+			if !redundant {
+				gathering.Candidates = append(gathering.Candidates, c)
+			}
+		}
+	}
+	return gathering, nil
+}
+
+// reflexive asks every server of the family of host for its mapping.
+func (g *Gatherer) reflexive(ctx context.Context, host *Candidate) []*Candidate {
+	network := "udp4"
+	if host.Addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	a := newAgent(host.base, nil)
+	if g.rto > 0 {
+		a.rto = g.rto
+	}
+	if g.maxSends > 0 {
+		a.maxSends = g.maxSends
+	}
+	defer a.close()
+
+	// the outstanding requests fail when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.shutdown(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	found := make([]*Candidate, len(g.opts.Servers))
+	var wg sync.WaitGroup
+	for i, server := range g.opts.Servers {
+		addrStr := server
+		if isURI(server) {
+			uri, err := ParseURI(server)
+			if err != nil {
+				continue
+			}
+			addrStr = uri.Addr()
+		}
+		serverAddr, err := net.ResolveUDPAddr(network, addrStr)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, server string, serverAddr *net.UDPAddr) {
+			defer wg.Done()
+			reply, err := a.do(buildBindingRequestRFC5389(false, false), serverAddr, func(p *packet) bool {
+				return p.getReflexiveAddr() != nil
+			})
+			if err != nil || reply == nil {
+				return
+			}
+			localPref := int(host.Priority>>8) & 0xffff
+			found[i] = &Candidate{
+				Foundation:  candidateFoundation(CandidateServerReflexive, host.Addr.IP, server),
+				Component:   host.Component,
+				Priority:    CandidatePriority(CandidateServerReflexive, localPref, host.Component),
+				Type:        CandidateServerReflexive,
+				Addr:        reply.getReflexiveAddr(),
+				RelatedAddr: host.Addr,
+				base:        host.base,
+			}
+		}(i, server, serverAddr)
+	}
+	wg.Wait()
+
+	candidates := make([]*Candidate, 0, len(found))
+	for _, c := range found {
+		if c != nil {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// hostIPs lists the addresses of the interfaces which are up.
+func hostIPs(ipv6, loopback bool) ([]net.IP, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || (ifi.Flags&net.FlagLoopback != 0 && !loopback) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ip, _, err := net.ParseCIDR(addr.String())
+			if err != nil || (ip.To4() == nil && !ipv6) {
+				continue
+			}
+			if ip.IsGlobalUnicast() || (loopback && ip.IsLoopback()) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// AddTo gives the sockets and the reflexive candidates to an ICE agent.
+func (g *Gathering) AddTo(a *ICEAgent) error {
+	for _, conn := range g.Conns {
+		if _, err := a.AddLocalSocket(conn); err != nil {
+			return err
+		}
+	}
+	for _, c := range g.Candidates {
+		if c.Type == CandidateHost {
+			continue
+		}
+		if err := a.AddLocalCandidate(c, c.base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the host sockets.
+func (g *Gathering) Close() {
+	for _, conn := range g.Conns {
+		conn.Close()
+	}
+}
+
+// SDP formats the candidate as an SDP attribute (RFC 8839 5.1):
+//
+//	a=candidate:<foundation> <component> UDP <priority> <ip> <port> typ <type> [raddr <ip> rport <port>]
+func (c *Candidate) SDP() string {
+	var b strings.Builder
+	b.WriteString("a=candidate:")
+	b.WriteString(c.Foundation)
+	b.WriteString(" " + strconv.Itoa(c.Component))
+	b.WriteString(" UDP")
+	b.WriteString(" " + strconv.FormatUint(uint64(c.Priority), 10))
+	b.WriteString(" " + c.Addr.IP.String())
+	b.WriteString(" " + strconv.Itoa(c.Addr.Port))
+	b.WriteString(" typ " + c.Type.String())
+	if c.RelatedAddr != nil {
+		b.WriteString(" raddr " + c.RelatedAddr.IP.String())
+		b.WriteString(" rport " + strconv.Itoa(c.RelatedAddr.Port))
+	}
+	return b.String()
+}
+
+// ParseCandidate parses an SDP candidate attribute, with or without the
+// "a=" prefix. Extension attributes after the type are ignored.
+func ParseCandidate(s string) (*Candidate, error) {
+	s = strings.TrimSpace(s)
+	value := strings.TrimPrefix(s, "a=")
+	if !strings.HasPrefix(value, "candidate:") {
+		return nil, errors.New("not a candidate attribute:" + s)
+	}
+	value = strings.TrimPrefix(value, "candidate:")
+	fields := strings.Fields(value)
+	if len(fields) < 8 || fields[6] != "typ" {
+		return nil, errors.New("malformed candidate attribute:" + s)
+	}
+	if !strings.EqualFold(fields[2], "udp") {
+		return nil, errors.New("unsupported candidate transport:" + fields[2])
+	}
+
+	c := &Candidate{Foundation: fields[0]}
+	var err error
+	if c.Component, err = strconv.Atoi(fields[1]); err != nil || c.Component < 1 || c.Component > 256 {
+		return nil, errors.New("invalid candidate component:" + fields[1])
+	}
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, errors.New("invalid candidate priority:" + fields[3])
+	}
+	c.Priority = uint32(priority)
+	if c.Addr, err = parseCandidateAddr(fields[4], fields[5]); err != nil {
+		return nil, err
+	}
+	typ, ok := candidateTypeByName(fields[7])
+	if !ok {
+		return nil, errors.New("unknown candidate type:" + fields[7])
+	}
+	c.Type = typ
+
+	var raddr, rport string
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			raddr = fields[i+1]
+		case "rport":
+			rport = fields[i+1]
+		}
+	}
+	if raddr != "" && rport != "" {
+		if c.RelatedAddr, err = parseCandidateAddr(raddr, rport); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func parseCandidateAddr(ipStr, portStr string) (*net.UDPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		// mDNS host names (RFC 8839 5.1) are not resolved here
+		return nil, errors.New("invalid candidate address:" + ipStr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid candidate port:" + portStr)
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+func candidateTypeByName(name string) (CandidateType, bool) {
+	for t, s := range candidateTypeDescription {
+		if s == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGather(t *testing.T) {
+	first := newTestServer(t)
+	first.setHandler(natResponse(0))
+	same := newTestServer(t)
+	same.setHandler(natResponse(0))
+	other := newTestServer(t)
+	other.setHandler(natResponse(5))
+
+	g := NewGatherer(GatherOptions{
+		Servers: []string{first.udpAddr(), same.udpAddr(), other.udpAddr(), "127.0.0.1:1"},
+		IPs:     []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	g.rto = 10 * time.Millisecond
+	g.maxSends = 3
+	gathering, err := g.Gather(context.Background())
+	if err != nil {
+		t.Skip("can not gather on loopback:", err)
+	}
+	defer gathering.Close()
+
+	/*
+	 * one host candidate, and one server reflexive candidate per distinct
+	 * mapping: the two servers reporting the same one give one candidate
+	 */
+	if len(gathering.Candidates) != 3 {
+		t.Fatalf("candidates %v", gathering.Candidates)
+	}
+	host := gathering.Candidates[0]
+	if host.Type != CandidateHost || host.Priority != CandidatePriority(CandidateHost, maxLocalPreference, 1) {
+		t.Errorf("host candidate %v", host)
+	}
+	for _, c := range gathering.Candidates[1:] {
+		if c.Type != CandidateServerReflexive || !c.Addr.IP.Equal(testNATIP) || !addrEqual(c.RelatedAddr, host.Addr) {
+			t.Errorf("server reflexive candidate %v", c)
+		}
+		if c.Priority >= host.Priority {
+			t.Errorf("server reflexive priority %d above the host one %d", c.Priority, host.Priority)
+		}
+	}
+	if gathering.Candidates[1].Foundation == gathering.Candidates[2].Foundation {
+		t.Errorf("candidates from different servers share the foundation %s", gathering.Candidates[1].Foundation)
+	}
+}
+
+func TestCandidateSDP(t *testing.T) {
+	c := &Candidate{
+		Foundation:  "1234",
+		Component:   1,
+		Priority:    CandidatePriority(CandidateServerReflexive, 65535, 1),
+		Type:        CandidateServerReflexive,
+		Addr:        &net.UDPAddr{IP: testNATIP, Port: 40000},
+		RelatedAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000},
+	}
+	sdp := c.SDP()
+	want := "a=candidate:1234 1 UDP 1694498815 192.0.2.1 40000 typ srflx raddr 10.0.0.2 rport 5000"
+	if sdp != want {
+		t.Errorf("SDP %q, expect %q", sdp, want)
+	}
+	parsed, err := ParseCandidate(sdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Foundation != c.Foundation || parsed.Priority != c.Priority || parsed.Type != c.Type ||
+		!addrEqual(parsed.Addr, c.Addr) || !addrEqual(parsed.RelatedAddr, c.RelatedAddr) {
+		t.Errorf("parsed %v from %q", parsed, sdp)
+	}
+
+	/*
+	 * the browser form, without the a= prefix and with extensions
+	 */
+	parsed, err = ParseCandidate("candidate:842163049 1 udp 2122260223 2001:db8::1 54400 typ host generation 0 ufrag EsAw")
+	if err != nil || parsed.Type != CandidateHost || parsed.Addr.Port != 54400 || parsed.RelatedAddr != nil {
+		t.Errorf("parsed %v, %v", parsed, err)
+	}
+
+	for _, bad := range []string{
+		"a=candidate:1 1 UDP 1 192.0.2.1 40000",
+		"a=candidate:1 1 TCP 1 192.0.2.1 40000 typ host",
+		"a=candidate:1 1 UDP 1 host.local 40000 typ host",
+		"a=candidate:1 1 UDP 1 192.0.2.1 40000 typ nat",
+		"a=fingerprint:sha-256 00",
+		"a=foo:1 1 UDP 1 192.0.2.1 40000 typ host",
+		"1 1 UDP 1 192.0.2.1 40000 typ host",
+	} {
+		if _, err := ParseCandidate(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
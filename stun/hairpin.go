@@ -0,0 +1,135 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// sends of the hairpinned request, the packet never leaves the NAT so the
+// test does not wait for the whole RFC 3489 schedule
+const hairpinMaxSends = 4
+
+// Hairpin is the outcome of the hairpinning test.
+type Hairpin struct {
+	// Supported tells the NAT loops packets sent to one of its mappings
+	// back to the internal host.
+	Supported bool
+	// ExternalSource tells the looped back packet carries the mapped
+	// address of the sender as source (RFC 4787 REQ-9), rather than its
+	// internal address.
+	ExternalSource bool
+	SourceAddr     *net.UDPAddr
+}
+
+func (h *Hairpin) String() string {
+	if !h.Supported {
+		return "not supported"
+	}
+	if h.ExternalSource {
+		return "supported, external source " + h.SourceAddr.String()
+	}
+	return "supported, internal source " + h.SourceAddr.String()
+}
+
+/*
+ * send a Binding-Request from a second local socket Y to the MAPPED-ADDRESS
+ * of test I, wait for it to arrive on the client socket
+ */
+func (c *Client) doHairpinTest() (*Hairpin, error) {
+	y, err := c.listenUDP(&net.UDPAddr{IP: c.nLocalAddr.IP})
+	if err != nil {
+		return nil, err
+	}
+	defer y.Close()
+	ay := c.newAgent(y)
+	defer ay.close()
+
+	// the mapping of Y tells the external source from the internal one
+	reply, err := ay.do(buildBindingRequest(false, false), c.nSrvAddr, func(p *packet) bool {
+		return p.getMappedAddr() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New("the STUN server had NO answer")
+	}
+	yMapped := reply.getMappedAddr()
+	yLocal := toUDPAddr(y.LocalAddr())
+
+	rqst := buildBindingRequest(false, false)
+	arrived := c.expectRequest(rqst.transID)
+	defer c.forgetRequest(rqst.transID)
+	ay.setMaxSends(hairpinMaxSends)
+	sent := ay.start(rqst, c.nMappedAddr, nil, nil)
+
+	var p *packet
+	select {
+	case p = <-arrived:
+	case <-sent.done:
+		// the last copy was sent and nothing arrived yet, give it its time
+		// before giving up
+		select {
+		case p = <-arrived:
+		case <-time.After(defRetransmitIntervalMs * time.Millisecond):
+		}
+	}
+
+	hairpin := &Hairpin{}
+	if p != nil {
+		hairpin.Supported = true
+		hairpin.SourceAddr = p.orgHost
+		hairpin.ExternalSource = addrEqual(p.orgHost, yMapped) && !addrEqual(p.orgHost, yLocal)
+	}
+	return hairpin, nil
+}
+
+// expectRequest registers for an incoming request with transID, which the
+// agent of the client socket hands over through handleRequest.
+func (c *Client) expectRequest(transID []byte) <-chan *packet {
+	ch := make(chan *packet, 1)
+	c.mu.Lock()
+	if c.incoming == nil {
+		c.incoming = make(map[string]chan *packet)
+	}
+	c.incoming[string(transID)] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *Client) forgetRequest(transID []byte) {
+	c.mu.Lock()
+	delete(c.incoming, string(transID))
+	c.mu.Unlock()
+}
+
+// handleRequest receives the requests and indications read by the agents
+// of the client.
+func (c *Client) handleRequest(p *packet) {
+	c.mu.Lock()
+	ch := c.incoming[string(p.transID)]
+	c.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- p:
+	default:
+	}
+}
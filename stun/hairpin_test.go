@@ -0,0 +1,98 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHairpinTest(t *testing.T) {
+	srv := newTestServer(t)
+	client := NewClient()
+	if err := client.prepare(srv.udpAddr()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.release()
+	if _, err := client.doBinding(client.nSrvAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a NAT the request from Y reaches the client socket directly,
+	// with the address of Y as both its internal and external source
+	hairpin, err := client.doHairpinTest()
+	if err != nil {
+		t.Fatalf("hairpin test error: %v", err)
+	}
+	if !hairpin.Supported || hairpin.SourceAddr == nil {
+		t.Errorf("hairpinned request not received: %v", hairpin)
+	}
+}
+
+// hairpinNAT is the public side of a test NAT: what is sent to it loops
+// back to the client socket from its own address, or is dropped.
+type hairpinNAT struct {
+	conn net.PacketConn
+	to   *net.UDPAddr
+	loop bool
+}
+
+func newHairpinNAT(t *testing.T, to *net.UDPAddr, loop bool) *hairpinNAT {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	n := &hairpinNAT{conn: conn, to: to, loop: loop}
+	go n.serve()
+	return n
+}
+
+func (n *hairpinNAT) addr() *net.UDPAddr {
+	return toUDPAddr(n.conn.LocalAddr())
+}
+
+func (n *hairpinNAT) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		k, _, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n.loop {
+			_, _ = n.conn.WriteTo(buf[:k], n.to)
+		}
+	}
+}
+
+func TestHairpinTestBehindNAT(t *testing.T) {
+	for _, loop := range []bool{true, false} {
+		srv := newTestServer(t)
+		client := NewClient()
+		client.rto = 10 * time.Millisecond
+		if err := client.prepare(srv.udpAddr()); err != nil {
+			t.Fatal(err)
+		}
+		/*
+		 * every socket is mapped to the public address of the NAT, which
+		 * loops the packets back to the client socket
+		 */
+		nat := newHairpinNAT(t, client.nLocalAddr, loop)
+		srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+			return bindingResponse(req, nat.addr())
+		})
+		if _, err := client.doBinding(client.nSrvAddr); err != nil {
+			t.Fatal(err)
+		}
+		hairpin, err := client.doHairpinTest()
+		client.release()
+		if err != nil {
+			t.Fatalf("hairpin test error: %v", err)
+		}
+		if hairpin.Supported != loop {
+			t.Errorf("loop %v: %v", loop, hairpin)
+		}
+		if loop && (!hairpin.ExternalSource || !addrEqual(hairpin.SourceAddr, nat.addr())) {
+			t.Errorf("hairpinned from %v, expect the external source %v", hairpin.SourceAddr, nat.addr())
+		}
+	}
+}
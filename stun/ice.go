@@ -0,0 +1,759 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CandidateType is the kind of an ICE candidate.
+type CandidateType int
+
+// Candidate types.
+const (
+	CandidateHost CandidateType = iota
+	CandidateServerReflexive
+	CandidatePeerReflexive
+	CandidateRelay
+)
+
+var candidateTypeDescription = map[CandidateType]string{
+	CandidateHost:            "host",
+	CandidateServerReflexive: "srflx",
+	CandidatePeerReflexive:   "prflx",
+	CandidateRelay:           "relay",
+}
+
+func (t CandidateType) String() string {
+	if s, ok := candidateTypeDescription[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// the type preferences recommended by RFC 8445 5.1.2.2
+var candidateTypePreference = map[CandidateType]uint32{
+	CandidateHost:            126,
+	CandidatePeerReflexive:   110,
+	CandidateServerReflexive: 100,
+	CandidateRelay:           0,
+}
+
+// maxLocalPreference is the local preference of the first host address.
+const maxLocalPreference = 65535
+
+// Candidate is a transport address an ICE agent may be reached on.
+type Candidate struct {
+	Foundation string
+	Component  int
+	Priority   uint32
+	Type       CandidateType
+	Addr       *net.UDPAddr
+	// RelatedAddr is the base of a reflexive candidate.
+	RelatedAddr *net.UDPAddr
+
+	// base is the local socket of a local candidate
+	base net.PacketConn
+}
+
+func (c *Candidate) String() string {
+	return fmt.Sprintf("%v %v (priority %d)", c.Type, c.Addr, c.Priority)
+}
+
+// CandidatePriority is the RFC 8445 5.1.2.1 priority of a candidate.
+func CandidatePriority(typ CandidateType, localPref, component int) uint32 {
+	return candidateTypePreference[typ]<<24 | uint32(localPref&0xffff)<<8 | uint32(256-component)&0xff
+}
+
+// candidateFoundation is equal for candidates of the same type, from the
+// same base IP and learned from the same server (RFC 8445 5.1.1.3).
+func candidateFoundation(typ CandidateType, base net.IP, server string) string {
+	h := fnv.New32a()
+	h.Write([]byte(typ.String()))
+	h.Write(base.To16())
+	h.Write([]byte(server))
+	return strconv.FormatUint(uint64(h.Sum32()), 10)
+}
+
+// CandidatePairState is the state of a pair in the check list.
+type CandidatePairState int
+
+// Candidate pair states.
+const (
+	PairFrozen CandidatePairState = iota
+	PairWaiting
+	PairInProgress
+	PairSucceeded
+	PairFailed
+)
+
+var candidatePairStateDescription = map[CandidatePairState]string{
+	PairFrozen:     "frozen",
+	PairWaiting:    "waiting",
+	PairInProgress: "in progress",
+	PairSucceeded:  "succeeded",
+	PairFailed:     "failed",
+}
+
+func (s CandidatePairState) String() string {
+	if d, ok := candidatePairStateDescription[s]; ok {
+		return d
+	}
+	return "unknown"
+}
+
+// CandidatePair is a local and a remote candidate checked together.
+type CandidatePair struct {
+	Local     *Candidate
+	Remote    *Candidate
+	State     CandidatePairState
+	Nominated bool
+
+	priority uint64
+	// the peer sent USE-CANDIDATE on this pair
+	useCandidate bool
+}
+
+func (p *CandidatePair) String() string {
+	return fmt.Sprintf("%v -> %v (%v)", p.Local.Addr, p.Remote.Addr, p.State)
+}
+
+func (p *CandidatePair) foundation() string {
+	return p.Local.Foundation + ":" + p.Remote.Foundation
+}
+
+// pairPriority is the RFC 8445 6.1.2.3 priority, g from the controlling
+// agent and d from the controlled one.
+func pairPriority(g, d uint32) uint64 {
+	min, max := uint64(g), uint64(d)
+	if min > max {
+		min, max = max, min
+	}
+	p := min<<32 + 2*max
+	if g > d {
+		p++
+	}
+	return p
+}
+
+const (
+	defICETa = 50 * time.Millisecond
+	// RFC 8445 5.3 asks for at least 24 bits of ufrag and 128 of pwd
+	iceUfragLen = 8
+	icePwdLen   = 24
+)
+
+// ICEConfig configures an ICEAgent.
+type ICEConfig struct {
+	// Controlling is the initial role, conflicts are resolved with the
+	// peer. An ICE-lite agent is always controlled.
+	Controlling bool
+	// Lite makes the agent an ICE-lite responder: it answers the checks of
+	// the peer and takes its nomination, but sends no checks.
+	Lite bool
+	// Ufrag and Pwd are the local credentials, generated when empty.
+	Ufrag string
+	Pwd   string
+	// Ta is the pacing of the checks, 50ms by default.
+	Ta time.Duration
+}
+
+// ICEAgent runs the RFC 8445 connectivity checks of one component over
+// local sockets. The sockets are read by the agent until Close, they
+// should carry STUN only, as the STUNConn of a Mux does.
+type ICEAgent struct {
+	cfg        ICEConfig
+	ufrag      string
+	pwd        string
+	tiebreaker uint64
+
+	// retransmission schedule override of the checks, zero keeps RFC 3489
+	rto      time.Duration
+	maxSends int
+
+	mu          sync.Mutex
+	controlling bool
+	remoteUfrag string
+	remotePwd   string
+	locals      []*Candidate
+	remotes     []*Candidate
+	sockets     map[net.PacketConn]*agent
+	checklist   []*CandidatePair
+	triggered   []iceCheck
+	nominating  *CandidatePair
+	selected    *CandidatePair
+	prflxCount  int
+	started     bool
+	closed      bool
+	failed      bool
+	selectedCh  chan struct{}
+	failedCh    chan struct{}
+	stop        chan struct{}
+}
+
+// iceCheck is a check waiting in the triggered check queue.
+type iceCheck struct {
+	pair     *CandidatePair
+	nominate bool
+}
+
+// NewICEAgent creates an agent, add the local sockets, then the remote
+// credentials and candidates, and Connect.
+func NewICEAgent(cfg ICEConfig) (*ICEAgent, error) {
+	if cfg.Ta <= 0 {
+		cfg.Ta = defICETa
+	}
+	if cfg.Lite {
+		cfg.Controlling = false
+	}
+	a := &ICEAgent{
+		cfg:         cfg,
+		ufrag:       cfg.Ufrag,
+		pwd:         cfg.Pwd,
+		controlling: cfg.Controlling,
+		sockets:     make(map[net.PacketConn]*agent),
+		selectedCh:  make(chan struct{}),
+		failedCh:    make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	var err error
+	if a.ufrag == "" {
+		if a.ufrag, err = iceString(iceUfragLen); err != nil {
+			return nil, err
+		}
+	}
+	if a.pwd == "" {
+		if a.pwd, err = iceString(icePwdLen); err != nil {
+			return nil, err
+		}
+	}
+	tiebreaker := make([]byte, 8)
+	if _, err := rand.Read(tiebreaker); err != nil {
+		return nil, err
+	}
+	a.tiebreaker = binary.BigEndian.Uint64(tiebreaker)
+	return a, nil
+}
+
+// iceString is a random string of ice-chars.
+func iceString(n int) (string, error) {
+	const iceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = iceChars[int(b[i])%len(iceChars)]
+	}
+	return string(b), nil
+}
+
+// LocalCredentials returns the ufrag and pwd to signal to the peer.
+func (a *ICEAgent) LocalCredentials() (string, string) {
+	return a.ufrag, a.pwd
+}
+
+// Controlling tells the current role, which a role conflict may change.
+func (a *ICEAgent) Controlling() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.controlling
+}
+
+// AddLocalSocket adds a socket, bound to a specific address, as a host
+// candidate and starts answering checks on it.
+func (a *ICEAgent) AddLocalSocket(conn net.PacketConn) (*Candidate, error) {
+	addr := toUDPAddr(conn.LocalAddr())
+	if addr == nil || addr.IP.IsUnspecified() {
+		return nil, errors.New("ICE socket not bound to an address:" + conn.LocalAddr().String())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, errors.New("ICE agent closed")
+	}
+	if _, ok := a.sockets[conn]; ok {
+		return nil, errors.New("ICE socket added twice:" + addr.String())
+	}
+	c := &Candidate{
+		Foundation: candidateFoundation(CandidateHost, addr.IP, ""),
+		Component:  1,
+		Priority:   CandidatePriority(CandidateHost, maxLocalPreference-len(a.sockets), 1),
+		Type:       CandidateHost,
+		Addr:       addr,
+		base:       conn,
+	}
+	ag := newAgent(conn, func(p *packet) {
+		a.handleRequest(conn, p)
+	})
+	if a.rto > 0 {
+		ag.rto = a.rto
+	}
+	if a.maxSends > 0 {
+		ag.maxSends = a.maxSends
+	}
+	a.sockets[conn] = ag
+	a.locals = append(a.locals, c)
+	for _, r := range a.remotes {
+		a.addPair(c, r)
+	}
+	return c, nil
+}
+
+// AddLocalCandidate adds a reflexive or relayed candidate to advertise,
+// base is the socket it was obtained from. The checks run from the host
+// candidate of the base, the candidate itself is not paired.
+func (a *ICEAgent) AddLocalCandidate(c *Candidate, base net.PacketConn) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.sockets[base]; !ok {
+		return errors.New("the base socket of the candidate is not added")
+	}
+	c.base = base
+	a.locals = append(a.locals, c)
+	return nil
+}
+
+// LocalCandidates returns the candidates to signal to the peer, peer
+// reflexive candidates learned by the checks included.
+func (a *ICEAgent) LocalCandidates() []*Candidate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Candidate(nil), a.locals...)
+}
+
+// SetRemoteCredentials sets the ufrag and pwd signaled by the peer.
+func (a *ICEAgent) SetRemoteCredentials(ufrag, pwd string) {
+	a.mu.Lock()
+	a.remoteUfrag, a.remotePwd = ufrag, pwd
+	a.mu.Unlock()
+}
+
+// AddRemoteCandidate adds a candidate signaled by the peer, it may be
+// called while the checks run.
+func (a *ICEAgent) AddRemoteCandidate(c *Candidate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addRemote(c)
+}
+
+func (a *ICEAgent) addRemote(c *Candidate) {
+	for _, r := range a.remotes {
+		if addrEqual(r.Addr, c.Addr) {
+			return
+		}
+	}
+	a.remotes = append(a.remotes, c)
+	for _, l := range a.locals {
+		if l.Type == CandidateHost {
+			a.addPair(l, c)
+		}
+	}
+}
+
+// addPair adds a pair of the same family and component, Frozen when a
+// pair of the same foundation is being checked, else Waiting.
+func (a *ICEAgent) addPair(local, remote *Candidate) *CandidatePair {
+	if (local.Addr.IP.To4() == nil) != (remote.Addr.IP.To4() == nil) || local.Component != remote.Component {
+		return nil
+	}
+	if p := a.findPair(local.base, remote.Addr); p != nil {
+		return p
+	}
+	p := &CandidatePair{Local: local, Remote: remote, State: PairWaiting}
+	for _, q := range a.checklist {
+		if q.foundation() == p.foundation() && q.State != PairFailed && q.State != PairSucceeded {
+			p.State = PairFrozen
+			break
+		}
+	}
+	a.checklist = append(a.checklist, p)
+	a.sortChecklist()
+	return p
+}
+
+func (a *ICEAgent) findPair(base net.PacketConn, remote *net.UDPAddr) *CandidatePair {
+	for _, p := range a.checklist {
+		if p.Local.base == base && addrEqual(p.Remote.Addr, remote) {
+			return p
+		}
+	}
+	return nil
+}
+
+// sortChecklist recomputes the pair priorities for the current role.
+func (a *ICEAgent) sortChecklist() {
+	for _, p := range a.checklist {
+		if a.controlling {
+			p.priority = pairPriority(p.Local.Priority, p.Remote.Priority)
+		} else {
+			p.priority = pairPriority(p.Remote.Priority, p.Local.Priority)
+		}
+	}
+	sort.SliceStable(a.checklist, func(i, j int) bool {
+		return a.checklist[i].priority > a.checklist[j].priority
+	})
+}
+
+// Connect runs the checks, ICE-lite agents only answer them, until a pair
+// is nominated. The returned pair is a snapshot.
+func (a *ICEAgent) Connect(ctx context.Context) (*CandidatePair, error) {
+	a.mu.Lock()
+	if !a.started && !a.cfg.Lite {
+		a.started = true
+		go a.run()
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-a.selectedCh:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		selected := *a.selected
+		return &selected, nil
+	case <-a.failedCh:
+		return nil, errors.New("ICE checks failed on every candidate pair")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the checks and the reading of the sockets, which are left
+// open.
+func (a *ICEAgent) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.stop)
+	agents := make([]*agent, 0, len(a.sockets))
+	for _, ag := range a.sockets {
+		agents = append(agents, ag)
+	}
+	a.mu.Unlock()
+	for _, ag := range agents {
+		ag.close()
+	}
+}
+
+// run sends one check every Ta: a triggered check first, else the
+// ordinary check of the best Waiting pair, else of the best Frozen one.
+func (a *ICEAgent) run() {
+	ticker := time.NewTicker(a.cfg.Ta)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		if check, ok := a.nextCheck(); ok {
+			a.sendCheck(check)
+		}
+	}
+}
+
+func (a *ICEAgent) nextCheck() (iceCheck, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.remotePwd == "" || a.selected != nil {
+		return iceCheck{}, false
+	}
+
+	// regular nomination: the controlling agent nominates the best pair
+	// which succeeded, with a second check carrying USE-CANDIDATE
+	if a.controlling && a.nominating == nil {
+		for _, p := range a.checklist {
+			if p.State == PairSucceeded {
+				a.nominating = p
+				a.triggered = append([]iceCheck{{pair: p, nominate: true}}, a.triggered...)
+				break
+			}
+		}
+	}
+
+	for len(a.triggered) > 0 {
+		check := a.triggered[0]
+		a.triggered = a.triggered[1:]
+		if check.pair.State == PairInProgress || (check.pair.State == PairSucceeded && !check.nominate) {
+			continue
+		}
+		check.pair.State = PairInProgress
+		return check, true
+	}
+	for _, state := range []CandidatePairState{PairWaiting, PairFrozen} {
+		for _, p := range a.checklist {
+			if p.State == state {
+				p.State = PairInProgress
+				return iceCheck{pair: p}, true
+			}
+		}
+	}
+
+	pending := a.nominating != nil
+	for _, p := range a.checklist {
+		pending = pending || p.State != PairFailed
+	}
+	if len(a.checklist) > 0 && !pending && !a.failed {
+		a.failed = true
+		close(a.failedCh)
+	}
+	return iceCheck{}, false
+}
+
+// sendCheck sends the Binding request of a check from the base of the
+// local candidate.
+func (a *ICEAgent) sendCheck(check iceCheck) {
+	a.mu.Lock()
+	p := check.pair
+	ag := a.sockets[p.Local.base]
+	controlling := a.controlling
+	remotePwd := []byte(a.remotePwd)
+
+	rqst := buildBindingRequestRFC5389(false, false)
+	rqst.addAttribute(*newTextAttribute(attributeUsername, a.remoteUfrag+":"+a.ufrag))
+	prio := make([]byte, 4)
+	localPref := int(p.Local.Priority>>8) & 0xffff
+	binary.BigEndian.PutUint32(prio, CandidatePriority(CandidatePeerReflexive, localPref, p.Local.Component))
+	rqst.addAttribute(*newAttribute(attributePriority, prio))
+	tiebreaker := make([]byte, 8)
+	binary.BigEndian.PutUint64(tiebreaker, a.tiebreaker)
+	if controlling {
+		rqst.addAttribute(*newAttribute(attributeIceControlling, tiebreaker))
+	} else {
+		rqst.addAttribute(*newAttribute(attributeIceControlled, tiebreaker))
+	}
+	if check.nominate {
+		rqst.addAttribute(*newAttribute(attributeUseCandidate, nil))
+	}
+	rqst.addMessageIntegrity(remotePwd)
+	rqst.addFingerprint()
+	remote := p.Remote.Addr
+	a.mu.Unlock()
+
+	// the response must come from the address the check was sent to, and
+	// be signed with the password of the peer
+	fchk := func(r *packet) bool {
+		return addrEqual(r.orgHost, remote) && checkMessageIntegrity(r.raw, remotePwd)
+	}
+	ag.start(rqst, remote, fchk, func(r *packet, err error) {
+		a.checkDone(check, controlling, binary.BigEndian.Uint32(prio), r, err)
+	})
+}
+
+// checkDone processes the outcome of a check.
+func (a *ICEAgent) checkDone(check iceCheck, controlling bool, prio uint32, r *packet, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := check.pair
+	if check.nominate && a.nominating == p {
+		a.nominating = nil
+	}
+	if err != nil || r == nil {
+		p.State = PairFailed
+		return
+	}
+	if r.types == msgTypeBindingErrorResponse {
+		if r.getErrorCode() == errorCodeRoleConflict {
+			// RFC 8445 7.2.5.1: switch the role, unless a request of the
+			// peer already did, and check again
+			if a.controlling == controlling {
+				a.controlling = !controlling
+				a.sortChecklist()
+			}
+			p.State = PairWaiting
+			a.triggered = append(a.triggered, iceCheck{pair: p})
+			return
+		}
+		p.State = PairFailed
+		return
+	}
+
+	// a mapped address unknown locally is a peer reflexive candidate
+	if mapped := r.getXorMappedAddr(); mapped != nil {
+		known := false
+		for _, l := range a.locals {
+			known = known || addrEqual(l.Addr, mapped)
+		}
+		if !known {
+			a.locals = append(a.locals, &Candidate{
+				Foundation:  candidateFoundation(CandidatePeerReflexive, p.Local.Addr.IP, ""),
+				Component:   p.Local.Component,
+				Priority:    prio,
+				Type:        CandidatePeerReflexive,
+				Addr:        mapped,
+				RelatedAddr: p.Local.Addr,
+				base:        p.Local.base,
+			})
+		}
+	}
+
+	p.State = PairSucceeded
+	for _, q := range a.checklist {
+		if q.State == PairFrozen && q.foundation() == p.foundation() {
+			q.State = PairWaiting
+		}
+	}
+	if (check.nominate && controlling) || (!a.controlling && p.useCandidate) {
+		a.selectPair(p)
+	}
+}
+
+// selectPair ends the checks on a nominated pair.
+func (a *ICEAgent) selectPair(p *CandidatePair) {
+	p.Nominated = true
+	if a.selected == nil {
+		a.selected = p
+		close(a.selectedCh)
+	}
+}
+
+// handleRequest answers a check of the peer, resolves a role conflict, and
+// triggers a check on the pair the request came over.
+func (a *ICEAgent) handleRequest(conn net.PacketConn, r *packet) {
+	if r.types != msgTypeBindingRequest {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// the username is "local ufrag:remote ufrag" from our side
+	username := r.getUsername()
+	if username == "" || r.findAttr(attributeMessageIntegrity) == nil {
+		a.respondError(conn, r, errorCodeBadRequest, "Bad Request", false)
+		return
+	}
+	if !strings.HasPrefix(username, a.ufrag+":") ||
+		(a.remoteUfrag != "" && username != a.ufrag+":"+a.remoteUfrag) {
+		a.respondError(conn, r, errorCodeUnauthorized, "Unauthorized", false)
+		return
+	}
+	if !checkMessageIntegrity(r.raw, []byte(a.pwd)) {
+		a.respondError(conn, r, errorCodeUnauthorized, "Unauthorized", false)
+		return
+	}
+
+	// RFC 8445 7.3.1.1
+	if attr := r.findAttr(attributeIceControlling); attr != nil && a.controlling && len(attr.value) >= 8 {
+		if a.tiebreaker >= binary.BigEndian.Uint64(attr.value) {
+			a.respondError(conn, r, errorCodeRoleConflict, "Role Conflict", true)
+			return
+		}
+		a.controlling = false
+		a.sortChecklist()
+	} else if attr := r.findAttr(attributeIceControlled); attr != nil && !a.controlling && len(attr.value) >= 8 {
+		if a.tiebreaker >= binary.BigEndian.Uint64(attr.value) && !a.cfg.Lite {
+			a.controlling = true
+			a.sortChecklist()
+		} else {
+			a.respondError(conn, r, errorCodeRoleConflict, "Role Conflict", true)
+			return
+		}
+	}
+
+	resp, _ := newPacket()
+	resp.types = msgTypeBindingResponse
+	resp.transID = r.transID
+	resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, r.orgHost, r.transID))
+	resp.addMessageIntegrity([]byte(a.pwd))
+	resp.addFingerprint()
+	_, _ = conn.WriteTo(resp.serialize(), r.orgHost)
+
+	useCandidate := r.findAttr(attributeUseCandidate) != nil
+	var local *Candidate
+	for _, l := range a.locals {
+		if l.base == conn && l.Type == CandidateHost {
+			local = l
+		}
+	}
+	if local == nil {
+		return
+	}
+
+	// a source unknown is a peer reflexive remote candidate
+	remote := (*Candidate)(nil)
+	for _, c := range a.remotes {
+		if addrEqual(c.Addr, r.orgHost) {
+			remote = c
+		}
+	}
+	if remote == nil {
+		prio := uint32(0)
+		if attr := r.findAttr(attributePriority); attr != nil && len(attr.value) >= 4 {
+			prio = binary.BigEndian.Uint32(attr.value)
+		}
+		a.prflxCount++
+		remote = &Candidate{
+			Foundation: "prflx" + strconv.Itoa(a.prflxCount),
+			Component:  local.Component,
+			Priority:   prio,
+			Type:       CandidatePeerReflexive,
+			Addr:       r.orgHost,
+		}
+		a.addRemote(remote)
+	}
+	p := a.findPair(conn, remote.Addr)
+	if p == nil {
+		return
+	}
+
+	if a.cfg.Lite {
+		// a lite agent takes the pair of the nominating check at once
+		if useCandidate {
+			p.State = PairSucceeded
+			a.selectPair(p)
+		}
+		return
+	}
+	if useCandidate && !a.controlling {
+		p.useCandidate = true
+		if p.State == PairSucceeded {
+			a.selectPair(p)
+			return
+		}
+	}
+	if p.State != PairSucceeded && p.State != PairInProgress {
+		p.State = PairWaiting
+		a.triggered = append(a.triggered, iceCheck{pair: p})
+	}
+}
+
+// respondError answers a request with an error, signed unless the request
+// failed authentication.
+func (a *ICEAgent) respondError(conn net.PacketConn, r *packet, code int, reason string, sign bool) {
+	resp, _ := newPacket()
+	resp.types = msgTypeBindingErrorResponse
+	resp.transID = r.transID
+	resp.addAttribute(*newErrorCodeAttribute(code, reason))
+	if sign {
+		resp.addMessageIntegrity([]byte(a.pwd))
+	}
+	resp.addFingerprint()
+	_, _ = conn.WriteTo(resp.serialize(), r.orgHost)
+}
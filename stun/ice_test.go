@@ -0,0 +1,187 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageIntegrity(t *testing.T) {
+	key := []byte("password")
+	pkt := buildBindingRequestRFC5389(false, false)
+	pkt.addAttribute(*newTextAttribute(attributeUsername, "user:peer"))
+	pkt.addMessageIntegrity(key)
+	pkt.addFingerprint()
+	data := pkt.serialize()
+
+	p, err := parsePackage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.getUsername() != "user:peer" {
+		t.Errorf("username %q", p.getUsername())
+	}
+	if !checkMessageIntegrity(p.raw, key) {
+		t.Errorf("message integrity not verified")
+	}
+	if checkMessageIntegrity(p.raw, []byte("wrong")) {
+		t.Errorf("message integrity verified with a wrong key")
+	}
+
+	/*
+	 * a changed USERNAME, after the 20 bytes header, breaks the integrity
+	 */
+	tampered := append([]byte(nil), data...)
+	tampered[20+4] ^= 0xff
+	if checkMessageIntegrity(tampered, key) {
+		t.Errorf("message integrity verified on a tampered message")
+	}
+}
+
+func TestErrorCodeAttribute(t *testing.T) {
+	pkt, _ := newPacket()
+	pkt.types = msgTypeBindingErrorResponse
+	pkt.addAttribute(*newErrorCodeAttribute(errorCodeRoleConflict, "Role Conflict"))
+	p, err := parsePackage(pkt.serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.getErrorCode() != errorCodeRoleConflict {
+		t.Errorf("error code %d, expect %d", p.getErrorCode(), errorCodeRoleConflict)
+	}
+}
+
+func TestCandidatePriority(t *testing.T) {
+	if p := CandidatePriority(CandidateHost, 65535, 1); p != 126<<24|65535<<8|255 {
+		t.Errorf("host priority %d", p)
+	}
+	// the controlling side breaks the tie
+	if pairPriority(10, 20) != 10<<32+40 || pairPriority(20, 10) != 10<<32+41 {
+		t.Errorf("pair priorities %d %d", pairPriority(10, 20), pairPriority(20, 10))
+	}
+}
+
+// iceSide is an agent with one loopback socket.
+func iceSide(t *testing.T, cfg ICEConfig) (*ICEAgent, *Candidate) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	cfg.Ta = 5 * time.Millisecond
+	a, err := NewICEAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rto = 20 * time.Millisecond
+	a.maxSends = 5
+	t.Cleanup(a.Close)
+	c, err := a.AddLocalSocket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, c
+}
+
+// iceSignal gives each agent the credentials of the other, and the
+// candidates when candidates is set.
+func iceSignal(a, b *ICEAgent, ca, cb *Candidate, candidates bool) {
+	ufrag, pwd := a.LocalCredentials()
+	b.SetRemoteCredentials(ufrag, pwd)
+	ufrag, pwd = b.LocalCredentials()
+	a.SetRemoteCredentials(ufrag, pwd)
+	a.AddRemoteCandidate(&Candidate{Foundation: cb.Foundation, Component: 1, Priority: cb.Priority, Type: cb.Type, Addr: cb.Addr})
+	if candidates {
+		b.AddRemoteCandidate(&Candidate{Foundation: ca.Foundation, Component: 1, Priority: ca.Priority, Type: ca.Type, Addr: ca.Addr})
+	}
+}
+
+// iceConnect connects both agents and checks they selected the same path.
+func iceConnect(t *testing.T, a, b *ICEAgent) (*CandidatePair, *CandidatePair) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	type result struct {
+		pair *CandidatePair
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		p, err := b.Connect(ctx)
+		done <- result{p, err}
+	}()
+	pa, err := a.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := <-done
+	if rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	pb := rb.pair
+	if !addrEqual(pa.Local.Addr, pb.Remote.Addr) || !addrEqual(pa.Remote.Addr, pb.Local.Addr) {
+		t.Errorf("selected pairs differ: %v and %v", pa, pb)
+	}
+	if !pa.Nominated || !pb.Nominated {
+		t.Errorf("selected pairs not nominated: %v and %v", pa, pb)
+	}
+	return pa, pb
+}
+
+func TestICEConnect(t *testing.T) {
+	a, ca := iceSide(t, ICEConfig{Controlling: true})
+	b, cb := iceSide(t, ICEConfig{})
+	iceSignal(a, b, ca, cb, true)
+	iceConnect(t, a, b)
+	if !a.Controlling() || b.Controlling() {
+		t.Errorf("roles changed without a conflict")
+	}
+}
+
+func TestICERoleConflict(t *testing.T) {
+	a, ca := iceSide(t, ICEConfig{Controlling: true})
+	b, cb := iceSide(t, ICEConfig{Controlling: true})
+	iceSignal(a, b, ca, cb, true)
+	iceConnect(t, a, b)
+	if a.Controlling() == b.Controlling() {
+		t.Errorf("role conflict not resolved, both controlling: %v", a.Controlling())
+	}
+}
+
+func TestICEPeerReflexive(t *testing.T) {
+	/*
+	 * b learns the candidate of a from its checks only
+	 */
+	a, ca := iceSide(t, ICEConfig{Controlling: true})
+	b, cb := iceSide(t, ICEConfig{})
+	iceSignal(a, b, ca, cb, false)
+	_, pb := iceConnect(t, a, b)
+	if pb.Remote.Type != CandidatePeerReflexive {
+		t.Errorf("remote candidate of b %v, expect peer reflexive", pb.Remote)
+	}
+}
+
+func TestICELite(t *testing.T) {
+	/*
+	 * a full agent, believing itself controlled, against a lite one
+	 */
+	a, ca := iceSide(t, ICEConfig{})
+	b, cb := iceSide(t, ICEConfig{Lite: true, Controlling: true})
+	iceSignal(a, b, ca, cb, true)
+	iceConnect(t, a, b)
+	if !a.Controlling() || b.Controlling() {
+		t.Errorf("the lite agent must end controlled")
+	}
+}
+
+func TestICEWrongPassword(t *testing.T) {
+	a, ca := iceSide(t, ICEConfig{Controlling: true})
+	b, cb := iceSide(t, ICEConfig{})
+	iceSignal(a, b, ca, cb, true)
+	a.SetRemoteCredentials(b.ufrag, "wrong password")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := a.Connect(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("expect the checks to fail, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// InterfaceResult is the outcome of one discovery bound to one interface.
+type InterfaceResult struct {
+	Interface  string
+	LocalAddr  *net.UDPAddr
+	MappedAddr *net.UDPAddr
+	NATType    NATType
+	Err        error
+}
+
+// DiscoverInterfaces runs a discovery once per usable interface, that is
+// every interface which is up, not a loopback, and has a global unicast
+// address of the server's family. The options are applied to every client,
+// the interface binding is added on top of them.
+func DiscoverInterfaces(srvAddrStr string, opts ...ClientOption) ([]InterfaceResult, error) {
+	if srvAddrStr == "" {
+		srvAddrStr = DefaultServerAddr
+	}
+	addrStr := srvAddrStr
+	if isURI(srvAddrStr) {
+		uri, err := ParseURI(srvAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		addrStr = uri.Addr()
+	}
+	serverUDPAddr, err := NewClient(opts...).resolveServer(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := serverUDPAddr.IP.To4() == nil
+
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	usable := make([]net.Interface, 0, len(ifis))
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if firstUsableIP(&ifi, ipv6) == nil {
+			continue
+		}
+		usable = append(usable, ifi)
+	}
+	if len(usable) == 0 {
+		return nil, errors.New("no usable network interface")
+	}
+
+	results := make([]InterfaceResult, len(usable))
+	var wg sync.WaitGroup
+	for i := range usable {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := usable[i].Name
+			cliOpts := append(append([]ClientOption{}, opts...), WithInterface(name))
+			client := NewClient(cliOpts...)
+			defer client.Close()
+			nat, err := client.Discovery(srvAddrStr)
+			results[i] = InterfaceResult{
+				Interface:  name,
+				LocalAddr:  client.LocalAddr(),
+				MappedAddr: client.MappedAddr(),
+				NATType:    nat,
+				Err:        err,
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results, nil
+}
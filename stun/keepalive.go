@@ -0,0 +1,246 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// RFC 8445 Tr, the default keepalive interval of ICE
+	defKeepaliveInterval = 15 * time.Second
+	minKeepaliveInterval = time.Second
+	defKeepaliveCheck    = 4
+)
+
+// KeepaliveOptions configures a Keepalive, zero values take the defaults.
+type KeepaliveOptions struct {
+	// Server is the host:port of the STUN server refreshing the mapping.
+	Server string
+	// Interval between two keepalives. When zero it is derived from
+	// Lifetime, else it is 15s.
+	Interval time.Duration
+	// Lifetime of the mapping, for instance measured by MeasureLifetime;
+	// the keepalives are then sent at half of it.
+	Lifetime time.Duration
+	// CheckEvery makes every n-th keepalive a Binding-Request checking the
+	// mapped address, the others are Binding Indications which get no
+	// answer. 4 by default, 1 sends only requests.
+	CheckEvery int
+	// OnChange is called when a check finds a new mapped address.
+	OnChange func(old, new *net.UDPAddr)
+	// OnError is called when a check gets no answer.
+	OnError func(err error)
+}
+
+// Keepalive keeps the mapping of a socket open and watches its address.
+// The socket may be shared with the application through the STUNConn of a
+// Mux only: from the first check until Stop the keepalive reads from it,
+// and on a raw socket shared with the application it would take the
+// application datagrams and drop them.
+type Keepalive struct {
+	conn   net.PacketConn
+	opts   KeepaliveOptions
+	server *net.UDPAddr
+
+	// retransmission schedule override of the checks, zero keeps RFC 3489
+	rto      time.Duration
+	maxSends int
+
+	mu      sync.Mutex
+	mapped  *net.UDPAddr
+	started bool
+	// agent reads the socket for the checks, from the first one to Stop
+	agent    *agent
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewKeepalive creates a keepalive for the mapping of conn toward the
+// server.
+func NewKeepalive(conn net.PacketConn, opts KeepaliveOptions) (*Keepalive, error) {
+	server, err := net.ResolveUDPAddr("udp", opts.Server)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defKeepaliveInterval
+		if opts.Lifetime > 0 {
+			opts.Interval = opts.Lifetime / 2
+		}
+	}
+	if opts.Interval < minKeepaliveInterval {
+		opts.Interval = minKeepaliveInterval
+	}
+	if opts.CheckEvery <= 0 {
+		opts.CheckEvery = defKeepaliveCheck
+	}
+	return &Keepalive{
+		conn:   conn,
+		opts:   opts,
+		server: server,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Interval returns the interval in use, after the defaults.
+func (k *Keepalive) Interval() time.Duration {
+	return k.opts.Interval
+}
+
+// MappedAddr returns the mapped address of the last check.
+func (k *Keepalive) MappedAddr() *net.UDPAddr {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.mapped
+}
+
+// Start checks the mapping once, and keeps it alive from then on.
+func (k *Keepalive) Start() error {
+	if _, err := k.Check(); err != nil {
+		k.releaseAgent()
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.started {
+		return errors.New("keepalive already started")
+	}
+	select {
+	case <-k.stop:
+		return errors.New("keepalive stopped")
+	default:
+	}
+	k.started = true
+	go k.run()
+	return nil
+}
+
+// Stop stops sending keepalives and reading the socket, which is left
+// open. It returns at once when the keepalive was not started.
+func (k *Keepalive) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.stop)
+	})
+	k.mu.Lock()
+	started := k.started
+	k.mu.Unlock()
+	if started {
+		<-k.done
+	}
+	k.releaseAgent()
+}
+
+// releaseAgent stops reading the socket, until the next check.
+func (k *Keepalive) releaseAgent() {
+	k.mu.Lock()
+	a := k.agent
+	k.agent = nil
+	k.mu.Unlock()
+	if a != nil {
+		a.close()
+	}
+}
+
+func (k *Keepalive) run() {
+	defer close(k.done)
+	ticker := time.NewTicker(k.opts.Interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+		if n%k.opts.CheckEvery != 0 {
+			_ = k.indicate()
+			continue
+		}
+		if _, err := k.Check(); err != nil && k.opts.OnError != nil {
+			k.opts.OnError(err)
+		}
+	}
+}
+
+// indicate sends a Binding Indication, which refreshes the mapping without
+// an answer (RFC 5389 10.1.1).
+func (k *Keepalive) indicate() error {
+	pkt, err := newPacket()
+	if err != nil {
+		return err
+	}
+	pkt.types = msgTypeBindingIndication
+	binary.BigEndian.PutUint32(pkt.transID[:4], magicCookieRFC5389)
+	pkt.addFingerprint()
+	_, err = k.conn.WriteTo(pkt.serialize(), k.server)
+	return err
+}
+
+// checkAgent returns the agent of the checks, started by the first one.
+func (k *Keepalive) checkAgent() (*agent, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	select {
+	case <-k.stop:
+		return nil, errors.New("keepalive stopped")
+	default:
+	}
+	if k.agent == nil {
+		k.agent = newAgent(k.conn, nil)
+		if k.rto > 0 {
+			k.agent.rto = k.rto
+		}
+		if k.maxSends > 0 {
+			k.agent.maxSends = k.maxSends
+		}
+	}
+	return k.agent, nil
+}
+
+// Check sends a Binding-Request now and returns the mapped address,
+// reporting a change to OnChange. The checks share one reader of the
+// socket, until Stop.
+func (k *Keepalive) Check() (*net.UDPAddr, error) {
+	a, err := k.checkAgent()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := a.do(buildBindingRequestRFC5389(false, false), k.server, func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New("no response from STUN server:" + k.server.String())
+	}
+
+	mapped := reply.getReflexiveAddr()
+	k.mu.Lock()
+	old := k.mapped
+	k.mapped = mapped
+	k.mu.Unlock()
+	if old != nil && !addrEqual(old, mapped) && k.opts.OnChange != nil {
+		k.opts.OnChange(old, mapped)
+	}
+	return mapped, nil
+}
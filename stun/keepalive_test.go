@@ -0,0 +1,194 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveInterval(t *testing.T) {
+	k, err := NewKeepalive(nil, KeepaliveOptions{Server: "127.0.0.1:3478", Lifetime: 40 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Interval() != 20*time.Second {
+		t.Errorf("interval %v derived from a 40s lifetime, expect 20s", k.Interval())
+	}
+	k, _ = NewKeepalive(nil, KeepaliveOptions{Server: "127.0.0.1:3478"})
+	if k.Interval() != defKeepaliveInterval {
+		t.Errorf("default interval %v", k.Interval())
+	}
+	k, _ = NewKeepalive(nil, KeepaliveOptions{Server: "127.0.0.1:3478", Interval: 10 * time.Millisecond})
+	if k.Interval() != minKeepaliveInterval {
+		t.Errorf("interval %v below the minimum", k.Interval())
+	}
+}
+
+func TestKeepaliveStopNotStarted(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet { return nil })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer conn.Close()
+	k, err := NewKeepalive(conn, KeepaliveOptions{Server: srv.udpAddr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.rto = 5 * time.Millisecond
+	k.maxSends = 2
+	if err := k.Start(); err == nil {
+		t.Fatal("keepalive started without an answer")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		k.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a keepalive which failed to start")
+	}
+}
+
+// deadlineConn counts the read deadlines set on a PacketConn, which an
+// agent sets when it stops reading.
+type deadlineConn struct {
+	net.PacketConn
+	mu        sync.Mutex
+	deadlines int
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines++
+	c.mu.Unlock()
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func TestKeepaliveChecksShareReader(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(natResponse(0))
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer raw.Close()
+	conn := &deadlineConn{PacketConn: raw}
+	k, err := NewKeepalive(conn, KeepaliveOptions{Server: srv.udpAddr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.rto = 10 * time.Millisecond
+	k.maxSends = 4
+
+	// concurrent checks, one reader
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := k.Check()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("check error: %v", err)
+		}
+	}
+	conn.mu.Lock()
+	deadlines := conn.deadlines
+	conn.mu.Unlock()
+	if deadlines != 0 {
+		t.Errorf("the reader was stopped between the checks")
+	}
+
+	k.Stop()
+	if _, err := k.Check(); err == nil {
+		t.Error("check after Stop")
+	}
+}
+
+func TestKeepaliveSharedSocket(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	indications, shift := 0, 0
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.types == msgTypeBindingIndication {
+			indications++
+			return nil
+		}
+		return natResponse(shift)(req, from)
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	mux := NewMux(conn)
+	defer mux.Close()
+
+	changed := make(chan *net.UDPAddr, 1)
+	// an indication on the first tick, a check on the second
+	k, err := NewKeepalive(mux.STUNConn(), KeepaliveOptions{
+		Server:     srv.udpAddr(),
+		Interval:   minKeepaliveInterval,
+		CheckEvery: 2,
+		OnChange: func(old, new *net.UDPAddr) {
+			changed <- new
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.rto = 10 * time.Millisecond
+	k.maxSends = 4
+	if err := k.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer k.Stop()
+	first := k.MappedAddr()
+
+	// application data keeps flowing to the application while the
+	// keepalive runs
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer peer.Close()
+	if _, err := peer.WriteTo([]byte("application data"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = mux.AppConn().SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := mux.AppConn().ReadFrom(buf); err != nil || string(buf[:n]) != "application data" {
+		t.Fatalf("application read %q, %v", buf[:n], err)
+	}
+
+	mu.Lock()
+	shift = 9
+	mu.Unlock()
+	select {
+	case addr := <-changed:
+		if addr.Port != first.Port+9 {
+			t.Errorf("new mapped address %v, expect the port of %v shifted by 9", addr, first)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mapping change not reported")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if indications == 0 {
+		t.Errorf("no Binding Indication sent")
+	}
+}
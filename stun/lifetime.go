@@ -0,0 +1,185 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	defLifetimeMax       = 300 * time.Second
+	defLifetimePrecision = 5 * time.Second
+)
+
+// LifetimeOptions configures MeasureLifetime.
+type LifetimeOptions struct {
+	// Max is the upper bound of the search, 300s by default.
+	Max time.Duration
+	// Precision ends the search once the bounds are this close, 5s by
+	// default.
+	Precision time.Duration
+	// Progress, when not nil, is called after every probe with the idle
+	// time probed and whether the mapping survived it.
+	Progress func(idle time.Duration, alive bool)
+}
+
+// LifetimeResult is the outcome of MeasureLifetime.
+type LifetimeResult struct {
+	// Lifetime is the longest idle time the mapping was seen to survive.
+	Lifetime time.Duration
+	// Expired is the shortest idle time the mapping was seen to expire
+	// after, zero when it survived the upper bound.
+	Expired time.Duration
+	Probes  int
+}
+
+/*
+ * RFC 5780 4.6: create a mapping with a Binding-Request from socket X, stay
+ * idle for N seconds, then send a Binding-Request with RESPONSE-PORT set to
+ * the mapped port of X from a second socket Y. X receives the response if
+ * and only if its mapping is still alive. Every probe uses a new mapping,
+ * and a binary search over N finds the lifetime.
+ *
+ * The server must support RESPONSE-PORT. Both requests go to the primary
+ * address so that the response passes any filtering of the NAT.
+ */
+
+// MeasureLifetime measures how long the NAT keeps an idle UDP mapping.
+// A probe sleeps for its idle time, so a whole measurement takes a long
+// while; use Progress to follow it, and ctx to stop it, which returns the
+// error of ctx.
+func (c *Client) MeasureLifetime(ctx context.Context, srvAddrStr string, opts LifetimeOptions) (*LifetimeResult, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("lifetime measurement requires the UDP transport")
+	}
+	if opts.Max <= 0 {
+		opts.Max = defLifetimeMax
+	}
+	if opts.Precision <= 0 {
+		opts.Precision = defLifetimePrecision
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	// only the local IP chosen by prepare is kept, every probe opens its
+	// own pair of sockets
+	laddr := &net.UDPAddr{IP: c.nLocalAddr.IP}
+	c.release()
+
+	probe := func(idle time.Duration) (bool, error) {
+		return c.probeLifetime(ctx, laddr, idle)
+	}
+	// a mapping must survive no idle time at all, otherwise the server
+	// ignores RESPONSE-PORT
+	alive, err := probe(0)
+	if err != nil {
+		return nil, err
+	}
+	if !alive {
+		return nil, errors.New("the STUN server does not support RESPONSE-PORT")
+	}
+	return searchLifetime(opts, probe)
+}
+
+// searchLifetime binary searches the idle time between a surviving and an
+// expiring probe.
+func searchLifetime(opts LifetimeOptions, probe func(idle time.Duration) (bool, error)) (*LifetimeResult, error) {
+	result := &LifetimeResult{}
+	run := func(idle time.Duration) (bool, error) {
+		alive, err := probe(idle)
+		if err != nil {
+			return false, err
+		}
+		result.Probes++
+		if opts.Progress != nil {
+			opts.Progress(idle, alive)
+		}
+		return alive, nil
+	}
+
+	alive, err := run(opts.Max)
+	if err != nil {
+		return nil, err
+	}
+	if alive {
+		result.Lifetime = opts.Max
+		return result, nil
+	}
+
+	lo, hi := time.Duration(0), opts.Max
+	for hi-lo > opts.Precision {
+		mid := lo + (hi-lo)/2
+		alive, err := run(mid)
+		if err != nil {
+			return nil, err
+		}
+		if alive {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	result.Lifetime = lo
+	result.Expired = hi
+	return result, nil
+}
+
+// probeLifetime runs one probe on a new pair of sockets bound to laddr.
+func (c *Client) probeLifetime(ctx context.Context, laddr *net.UDPAddr, idle time.Duration) (bool, error) {
+	x, err := c.listenUDP(laddr)
+	if err != nil {
+		return false, err
+	}
+	defer x.Close()
+	y, err := c.listenUDP(laddr)
+	if err != nil {
+		return false, err
+	}
+	defer y.Close()
+	ax := c.newAgent(x)
+	defer ax.close()
+
+	fchk := func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	}
+	reply, err := ax.do(buildBindingRequestRFC5389(false, false), c.nSrvAddr, fchk)
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		return false, errors.New("the STUN server had NO answer")
+	}
+	mapped := reply.getReflexiveAddr()
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+	}
+
+	rqst := buildBindingRequestRFC5389(false, false)
+	rqst.addAttribute(*newResponsePortAttribute(mapped.Port))
+	reply, err = ax.startFrom(y, rqst, c.nSrvAddr, nil, nil).wait()
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
@@ -0,0 +1,110 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSearchLifetime(t *testing.T) {
+	const lifetime = 97 * time.Second
+	var probed []time.Duration
+	opts := LifetimeOptions{
+		Max:       300 * time.Second,
+		Precision: 2 * time.Second,
+		Progress: func(idle time.Duration, alive bool) {
+			probed = append(probed, idle)
+		},
+	}
+	result, err := searchLifetime(opts, func(idle time.Duration) (bool, error) {
+		return idle <= lifetime, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lifetime > lifetime || result.Expired <= lifetime {
+		t.Errorf("lifetime %v not within [%v, %v)", lifetime, result.Lifetime, result.Expired)
+	}
+	if result.Expired-result.Lifetime > opts.Precision {
+		t.Errorf("search ended with bounds %v apart", result.Expired-result.Lifetime)
+	}
+	if len(probed) != result.Probes {
+		t.Errorf("progress called %d times for %d probes", len(probed), result.Probes)
+	}
+}
+
+func TestSearchLifetimeUpperBound(t *testing.T) {
+	result, err := searchLifetime(LifetimeOptions{Max: time.Minute, Precision: time.Second},
+		func(idle time.Duration) (bool, error) {
+			return true, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lifetime != time.Minute || result.Expired != 0 || result.Probes != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestProbeLifetime(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	alive := true
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		mu.Lock()
+		defer mu.Unlock()
+		resp := bindingResponse(req, from)
+		attr := req.findAttr(attributeResponsePort)
+		if resp == nil || attr == nil {
+			return resp
+		}
+		/*
+		 * the response goes to the port of the first socket, unless the
+		 * mapping is gone: then it is answered to the second socket like a
+		 * NAT without the mapping would
+		 */
+		if alive {
+			to := &net.UDPAddr{IP: from.IP, Port: int(binary.BigEndian.Uint16(attr.value[0:2]))}
+			_, _ = srv.udp.WriteTo(resp.serialize(), to)
+			return nil
+		}
+		return resp
+	})
+
+	client := NewClient()
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 3
+	if err := client.prepare(srv.udpAddr()); err != nil {
+		t.Fatal(err)
+	}
+	laddr := &net.UDPAddr{IP: client.nLocalAddr.IP}
+	client.release()
+
+	ok, err := client.probeLifetime(context.Background(), laddr, 10*time.Millisecond)
+	if err != nil || !ok {
+		t.Errorf("mapping not alive: %v", err)
+	}
+	mu.Lock()
+	alive = false
+	mu.Unlock()
+	ok, err = client.probeLifetime(context.Background(), laddr, 0)
+	if err != nil || ok {
+		t.Errorf("expired mapping alive: %v", err)
+	}
+
+	// a whole measurement stops with the context
+	mu.Lock()
+	alive = true
+	mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.MeasureLifetime(ctx, srv.udpAddr(), LifetimeOptions{Max: time.Hour})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 2*time.Second {
+		t.Errorf("measurement not stopped: %v after %v", err, time.Since(start))
+	}
+}
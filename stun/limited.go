@@ -0,0 +1,172 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MappingProbe is the mapped address one server reported.
+type MappingProbe struct {
+	Server     *net.UDPAddr
+	MappedAddr *net.UDPAddr
+}
+
+// LimitedDetection is what a discovery learns from a server without
+// CHANGE-REQUEST support: the mapping behavior, found by comparing the
+// mapped addresses other servers report for the same socket. The filtering
+// behavior needs a server answering from another address, it stays unknown.
+type LimitedDetection struct {
+	Mapping MappingBehavior
+	// Probes are the answering servers, the discovery server first.
+	Probes []MappingProbe
+	// Undetermined lists what the servers could not tell.
+	Undetermined []string
+}
+
+func (l *LimitedDetection) String() string {
+	s := fmt.Sprintf("Limited detection: %v", l.Mapping)
+	for _, p := range l.Probes {
+		s += fmt.Sprintf("\n  %v: mapped %v", p.Server, p.MappedAddr)
+	}
+	if len(l.Undetermined) > 0 {
+		s += "\n  undetermined: " + strings.Join(l.Undetermined, "; ")
+	}
+	return s
+}
+
+// Limited returns the result of the detection without CHANGE-REQUEST of the
+// last discovery, nil when the server supported it.
+func (c *Client) Limited() *LimitedDetection {
+	return c.limited
+}
+
+/*
+ * the server answered test I without CHANGED-ADDRESS or OTHER-ADDRESS, so
+ * tests II to IV can not run. Send a Binding-Request from the same socket
+ * to each fallback server, concurrently, and compare the mappings: a
+ * mapping which changes with the destination is a symmetric NAT, the cone
+ * types differ by their filtering only and can not be told apart.
+ */
+func (c *Client) doDetectLimited() (NATType, error) {
+	l := &LimitedDetection{
+		Probes: []MappingProbe{{Server: c.nSrvAddr, MappedAddr: c.nMappedAddr}},
+	}
+	c.limited = l
+	l.Undetermined = append(l.Undetermined, "filtering behavior, the server does not support CHANGE-REQUEST")
+
+	if c.mappedIsLocal() {
+		// no NAT, whether a firewall filters can not be tested
+		l.Mapping = MappingEndpointIndependent
+		return NATTypeUnknown, nil
+	}
+
+	fchk := func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	}
+	var servers []*net.UDPAddr
+	var transactions []*transaction
+	for _, name := range c.fallbacks {
+		srv, err := c.resolveFallback(name)
+		if err != nil {
+			l.Undetermined = append(l.Undetermined, "fallback server "+name+": "+err.Error())
+			continue
+		}
+		if addrEqual(srv, c.nSrvAddr) {
+			continue
+		}
+		servers = append(servers, srv)
+		transactions = append(transactions, c.agent.start(buildBindingRequestRFC5389(false, false), srv, fchk, nil))
+	}
+	for i, t := range transactions {
+		reply, err := t.wait()
+		if err != nil {
+			return NATTypeError, err
+		}
+		if reply == nil {
+			l.Undetermined = append(l.Undetermined, "fallback server "+servers[i].String()+" had no answer")
+			continue
+		}
+		l.Probes = append(l.Probes, MappingProbe{Server: servers[i], MappedAddr: reply.getReflexiveAddr()})
+	}
+
+	var note string
+	l.Mapping, note = classifyMappings(l.Probes)
+	if note != "" {
+		l.Undetermined = append(l.Undetermined, note)
+	}
+	if l.Mapping == MappingAddressDependent || l.Mapping == MappingAddressAndPortDependent {
+		return NATTypeSymmetric, nil
+	}
+	return NATTypeUnknown, nil
+}
+
+// resolveFallback resolves a fallback server, a host:port address or a
+// stun: URI, in the family of the discovery server.
+func (c *Client) resolveFallback(name string) (*net.UDPAddr, error) {
+	addr := name
+	if isURI(name) {
+		uri, err := ParseURI(name)
+		if err != nil {
+			return nil, err
+		}
+		if uri.Secure() {
+			return nil, errors.New("stuns: URI used as UDP fallback server:" + name)
+		}
+		addr = uri.Addr()
+	}
+	// the socket is of the family of the server
+	srv, _, err := c.resolveFamily(addr, ipFamilyOf(c.nSrvAddr.IP))
+	return srv, err
+}
+
+// classifyMappings derives the mapping behavior from the mappings seen by
+// several servers, and notes what the set of servers can not tell. Two
+// servers on different IPs tell address dependence, two servers on the
+// same IP and different ports tell port dependence.
+func classifyMappings(probes []MappingProbe) (MappingBehavior, string) {
+	if len(probes) < 2 {
+		return MappingUnknown, "mapping behavior, no second server answered"
+	}
+	var otherIPSame, otherIPDiffer, otherPortSame, otherPortDiffer bool
+	for i := 0; i < len(probes); i++ {
+		for j := i + 1; j < len(probes); j++ {
+			a, b := probes[i], probes[j]
+			same := addrEqual(a.MappedAddr, b.MappedAddr)
+			if a.Server.IP.Equal(b.Server.IP) {
+				otherPortSame = otherPortSame || same
+				otherPortDiffer = otherPortDiffer || !same
+			} else {
+				otherIPSame = otherIPSame || same
+				otherIPDiffer = otherIPDiffer || !same
+			}
+		}
+	}
+	switch {
+	case otherPortDiffer:
+		return MappingAddressAndPortDependent, ""
+	case otherIPDiffer && otherPortSame:
+		return MappingAddressDependent, ""
+	case otherIPDiffer:
+		return MappingAddressDependent, "port dependence of the mapping, no two servers share an IP"
+	case otherIPSame:
+		return MappingEndpointIndependent, ""
+	}
+	return MappingUnknown, "address dependence of the mapping, all the servers share an IP"
+}
@@ -0,0 +1,107 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// natResponse answers like a server without CHANGE-REQUEST support behind
+// a NAT which maps the client port shifted by shift.
+func natResponse(shift int) func(req *packet, from *net.UDPAddr) *packet {
+	return func(req *packet, from *net.UDPAddr) *packet {
+		return bindingResponse(req, &net.UDPAddr{IP: testNATIP, Port: from.Port + shift})
+	}
+}
+
+func TestDiscoveryWithoutChangeRequest(t *testing.T) {
+	primary := newTestServer(t)
+	primary.setHandler(natResponse(0))
+	fallback := newTestServer(t)
+	fallback.setHandler(natResponse(7))
+
+	client := NewClient(WithFallbackServers(fallback.udpAddr()))
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 4
+	nat, err := client.Discovery(primary.udpAddr())
+	if err != nil {
+		t.Fatalf("discovery error: %v", err)
+	}
+	if nat != NATTypeSymmetric {
+		t.Errorf("NAT type %v, expect %v", nat, NATTypeSymmetric)
+	}
+	l := client.Limited()
+	if l == nil || l.Mapping != MappingAddressAndPortDependent || len(l.Probes) != 2 {
+		t.Fatalf("limited detection %v", l)
+	}
+	if client.evidence.Test1 != TestPassed {
+		t.Errorf("test I %v without CHANGED-ADDRESS", client.evidence.Test1)
+	}
+
+	// without fallback servers the NAT type is left open instead of UDP
+	// blocked
+	client = NewClient()
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 4
+	nat, err = client.Discovery(primary.udpAddr())
+	if err != nil || nat != NATTypeUnknown {
+		t.Errorf("discovery got %v, %v, expect %v", nat, err, NATTypeUnknown)
+	}
+	if l := client.Limited(); l == nil || l.Mapping != MappingUnknown || len(l.Undetermined) != 2 {
+		t.Errorf("limited detection %v", l)
+	}
+}
+
+func TestClassifyMappings(t *testing.T) {
+	srv := func(ip byte, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(198, 51, 100, ip), Port: port}
+	}
+	mapped := func(port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: testNATIP, Port: port}
+	}
+	cases := []struct {
+		name    string
+		probes  []MappingProbe
+		mapping MappingBehavior
+		note    bool
+	}{
+		{"single", []MappingProbe{{srv(1, 3478), mapped(1000)}}, MappingUnknown, true},
+		{"independent", []MappingProbe{{srv(1, 3478), mapped(1000)}, {srv(2, 3478), mapped(1000)}},
+			MappingEndpointIndependent, false},
+		{"same ip only", []MappingProbe{{srv(1, 3478), mapped(1000)}, {srv(1, 3479), mapped(1000)}},
+			MappingUnknown, true},
+		{"address", []MappingProbe{{srv(1, 3478), mapped(1000)}, {srv(2, 3478), mapped(1001)}},
+			MappingAddressDependent, true},
+		{"address only", []MappingProbe{{srv(1, 3478), mapped(1000)}, {srv(1, 3479), mapped(1000)},
+			{srv(2, 3478), mapped(1001)}}, MappingAddressDependent, false},
+		{"address and port", []MappingProbe{{srv(1, 3478), mapped(1000)}, {srv(1, 3479), mapped(1001)}},
+			MappingAddressAndPortDependent, false},
+	}
+	for _, tc := range cases {
+		mapping, note := classifyMappings(tc.probes)
+		if mapping != tc.mapping || (note != "") != tc.note {
+			t.Errorf("%s: got %v %q, expect %v", tc.name, mapping, note, tc.mapping)
+		}
+	}
+}
+
+func TestDiscoverBehaviorWithoutOtherAddress(t *testing.T) {
+	primary := newTestServer(t)
+	primary.setHandler(natResponse(0))
+	fallback := newTestServer(t)
+	fallback.setHandler(natResponse(7))
+
+	client := NewClient(WithFallbackServers("stun:" + fallback.udpAddr()))
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 4
+	b, err := client.DiscoverBehavior(primary.udpAddr())
+	if err != nil {
+		t.Fatalf("behavior discovery error: %v", err)
+	}
+	if b.Mapping != MappingAddressAndPortDependent || b.Filtering != FilteringUnknown {
+		t.Errorf("behavior %v", b)
+	}
+	if b.Limited == nil || len(b.Limited.Probes) != 2 {
+		t.Errorf("limited detection %v", b.Limited)
+	}
+}
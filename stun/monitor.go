@@ -0,0 +1,407 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// MonitorEventType is the kind of change a Monitor reports.
+type MonitorEventType int
+
+// Monitor events.
+const (
+	EventMappedAddrChanged MonitorEventType = iota
+	EventNATTypeChanged
+	EventServerUnreachable
+	EventServerReachable
+)
+
+var monitorEventDescription = map[MonitorEventType]string{
+	EventMappedAddrChanged: "mapped address changed",
+	EventNATTypeChanged:    "NAT type changed",
+	EventServerUnreachable: "server unreachable",
+	EventServerReachable:   "server reachable",
+}
+
+func (t MonitorEventType) String() string {
+	if s, ok := monitorEventDescription[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// MonitorEvent is one change seen by a Monitor.
+type MonitorEvent struct {
+	Type   MonitorEventType
+	Time   time.Time
+	Server string
+
+	OldAddr *net.UDPAddr
+	NewAddr *net.UDPAddr
+	OldType NATType
+	NewType NATType
+	// Err is the last failure of an unreachable server.
+	Err error
+}
+
+func (e MonitorEvent) String() string {
+	switch e.Type {
+	case EventMappedAddrChanged:
+		return fmt.Sprintf("%v: %v -> %v", e.Type, e.OldAddr, e.NewAddr)
+	case EventNATTypeChanged:
+		return fmt.Sprintf("%v: %v -> %v", e.Type, e.OldType, e.NewType)
+	case EventServerUnreachable:
+		return fmt.Sprintf("%v: %s (%v)", e.Type, e.Server, e.Err)
+	}
+	return fmt.Sprintf("%v: %s", e.Type, e.Server)
+}
+
+const (
+	defMonitorInterval     = 30 * time.Second
+	defMonitorFullInterval = 10 * time.Minute
+	defMonitorDebounce     = 2
+	defMonitorMaxBackoff   = 5 * time.Minute
+	monitorEventQueue      = 16
+)
+
+// MonitorOptions configures a Monitor, zero values take the defaults.
+type MonitorOptions struct {
+	Server string
+	// Interval between two Binding probes, 30s by default.
+	Interval time.Duration
+	// FullInterval between two full discoveries, 10 minutes by default, a
+	// negative value disables them and the NAT type is not watched.
+	FullInterval time.Duration
+	// Debounce is the number of consecutive observations confirming a
+	// change before it is reported, 2 by default.
+	Debounce int
+	// MaxBackoff bounds the probe interval, doubled after each failure
+	// once the server is reported unreachable. 5 minutes by default.
+	MaxBackoff time.Duration
+	// Callback, when set, is called with every event from the monitor
+	// goroutine, in addition to the Events channel.
+	Callback func(MonitorEvent)
+}
+
+// Monitor watches the mapping of one socket: a cheap Binding probe runs
+// on every interval and a full discovery from the same socket on the
+// longer one. Changes of the mapped address, of the NAT type, and of the
+// reachability of the server are reported once confirmed.
+type Monitor struct {
+	opts   MonitorOptions
+	client *Client
+	owned  net.PacketConn
+	events chan MonitorEvent
+
+	mu       sync.Mutex
+	mapped   *net.UDPAddr
+	nattype  NATType
+	started  bool
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// pending changes and failures, owned by the monitor goroutine
+	pendingAddr  *net.UDPAddr
+	addrCount    int
+	typeSeen     bool
+	pendingType  NATType
+	typeCount    int
+	failures     int
+	unreachable  bool
+	nextInterval time.Duration
+}
+
+// NewMonitor creates a monitor, the client options set the socket and the
+// transport of the probes.
+func NewMonitor(opts MonitorOptions, clientOpts ...ClientOption) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = defMonitorInterval
+	}
+	if opts.FullInterval == 0 {
+		opts.FullInterval = defMonitorFullInterval
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = defMonitorDebounce
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defMonitorMaxBackoff
+	}
+	return &Monitor{
+		opts:    opts,
+		client:  NewClient(clientOpts...),
+		events:  make(chan MonitorEvent, monitorEventQueue),
+		nattype: NATTypeUnknown,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Events returns the channel of events. Events are dropped when it is
+// full, the Callback gets all of them.
+func (m *Monitor) Events() <-chan MonitorEvent {
+	return m.events
+}
+
+// MappedAddr returns the confirmed mapped address, nil before the first
+// answer.
+func (m *Monitor) MappedAddr() *net.UDPAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mapped
+}
+
+// NATType returns the confirmed NAT type.
+func (m *Monitor) NATType() NATType {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nattype
+}
+
+// Start opens the monitored socket and starts watching. The first probe
+// and, unless disabled, the first full discovery run at once.
+func (m *Monitor) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started {
+		return errors.New("monitor already started")
+	}
+	select {
+	case <-m.stop:
+		return errors.New("monitor stopped")
+	default:
+	}
+	c := m.client
+	if err := c.prepare(m.opts.Server); err != nil {
+		return err
+	}
+	if c.transport == TransportUDP && c.sharedConn == nil {
+		// every run goes through the socket of the first one, its mapping
+		// is the one watched
+		c.sharedConn = c.conn
+		m.owned = c.conn
+	}
+	c.release()
+	m.started = true
+	go m.run()
+	return nil
+}
+
+// Stop stops watching and closes the socket, the Events channel is closed
+// once the monitor goroutine is done. A probe or discovery in progress on
+// the socket of the monitor is cut short, one on a socket given with
+// WithPacketConn or over TCP runs to its end first. Stop returns at once
+// when the monitor was not started.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	started, owned := m.started, m.owned
+	m.mu.Unlock()
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		if owned != nil {
+			// fails the outstanding transactions of the socket
+			_ = owned.Close()
+		}
+	})
+	if started {
+		<-m.done
+	}
+}
+
+func (m *Monitor) stopping() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Monitor) run() {
+	defer func() {
+		m.client.Close()
+		if m.owned != nil {
+			_ = m.owned.Close()
+		}
+		close(m.events)
+		close(m.done)
+	}()
+
+	m.nextInterval = m.opts.Interval
+	probe := time.NewTimer(0)
+	defer probe.Stop()
+	var full <-chan time.Time
+	if m.opts.FullInterval > 0 {
+		fullTicker := time.NewTicker(m.opts.FullInterval)
+		defer fullTicker.Stop()
+		full = fullTicker.C
+		m.fullRun()
+	}
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-probe.C:
+			m.probe()
+			probe.Reset(m.nextInterval)
+		case <-full:
+			m.fullRun()
+		}
+	}
+}
+
+// probe sends one Binding-Request from the monitored socket.
+func (m *Monitor) probe() {
+	mapped, err := m.client.Binding(m.opts.Server)
+	if err != nil {
+		m.failed(err)
+		return
+	}
+	m.answered()
+	m.observeAddr(mapped)
+}
+
+// fullRun runs a discovery from the monitored socket. A server which does
+// not answer test I counts as a failed probe rather than a change to UDP
+// blocked.
+func (m *Monitor) fullRun() {
+	nattyp, err := m.client.Discovery(m.opts.Server)
+	if err == nil && m.client.evidence != nil && m.client.evidence.Test1 != TestPassed {
+		err = errors.New("no response from STUN server:" + m.opts.Server)
+	}
+	if err != nil {
+		m.failed(err)
+		return
+	}
+	m.answered()
+	m.observeAddr(m.client.MappedAddr())
+	m.observeType(nattyp)
+}
+
+// failed counts a failure, the server is reported unreachable after
+// Debounce of them in a row and the probes then back off. The failures of
+// the runs cut short by Stop do not count.
+func (m *Monitor) failed(err error) {
+	if m.stopping() {
+		return
+	}
+	m.failures++
+	if m.failures < m.opts.Debounce {
+		return
+	}
+	if !m.unreachable {
+		m.unreachable = true
+		m.emit(MonitorEvent{Type: EventServerUnreachable, Err: err})
+	}
+	m.nextInterval *= 2
+	if m.nextInterval > m.opts.MaxBackoff {
+		m.nextInterval = m.opts.MaxBackoff
+	}
+}
+
+func (m *Monitor) answered() {
+	m.failures = 0
+	m.nextInterval = m.opts.Interval
+	if m.unreachable {
+		m.unreachable = false
+		m.emit(MonitorEvent{Type: EventServerReachable})
+	}
+}
+
+// observeAddr confirms a new mapped address once it was seen Debounce
+// times in a row. The first address is taken at once, silently.
+func (m *Monitor) observeAddr(addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	m.mu.Lock()
+	old := m.mapped
+	m.mu.Unlock()
+	if old == nil || addrEqual(addr, old) {
+		m.pendingAddr, m.addrCount = nil, 0
+		if old == nil {
+			m.mu.Lock()
+			m.mapped = addr
+			m.mu.Unlock()
+		}
+		return
+	}
+	if !addrEqual(addr, m.pendingAddr) {
+		m.pendingAddr, m.addrCount = addr, 0
+	}
+	m.addrCount++
+	if m.addrCount < m.opts.Debounce {
+		return
+	}
+	m.mu.Lock()
+	m.mapped = addr
+	m.mu.Unlock()
+	m.pendingAddr, m.addrCount = nil, 0
+	m.emit(MonitorEvent{Type: EventMappedAddrChanged, OldAddr: old, NewAddr: addr})
+}
+
+// observeType is observeAddr for the NAT type of the full discoveries,
+// NATTypeUnknown included.
+func (m *Monitor) observeType(nattyp NATType) {
+	m.mu.Lock()
+	old := m.nattype
+	m.mu.Unlock()
+	if !m.typeSeen || nattyp == old {
+		m.typeCount = 0
+		if !m.typeSeen {
+			m.typeSeen = true
+			m.mu.Lock()
+			m.nattype = nattyp
+			m.mu.Unlock()
+		}
+		return
+	}
+	if nattyp != m.pendingType {
+		m.pendingType, m.typeCount = nattyp, 0
+	}
+	m.typeCount++
+	if m.typeCount < m.opts.Debounce {
+		return
+	}
+	m.mu.Lock()
+	m.nattype = nattyp
+	m.mu.Unlock()
+	m.typeCount = 0
+	m.emit(MonitorEvent{Type: EventNATTypeChanged, OldType: old, NewType: nattyp})
+}
+
+func (m *Monitor) emit(e MonitorEvent) {
+	e.Time = time.Now()
+	e.Server = m.opts.Server
+	if m.opts.Callback != nil {
+		m.opts.Callback(e)
+	}
+	select {
+	case m.events <- e:
+	default:
+	}
+}
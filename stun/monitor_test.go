@@ -0,0 +1,128 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func waitEvent(t *testing.T, m *Monitor, typ MonitorEventType) MonitorEvent {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case e, ok := <-m.Events():
+			if !ok {
+				t.Fatalf("events closed waiting for %v", typ)
+			}
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %v event", typ)
+		}
+	}
+}
+
+func TestMonitorEvents(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(natResponse(0))
+
+	m := NewMonitor(MonitorOptions{
+		Server:       srv.udpAddr(),
+		Interval:     20 * time.Millisecond,
+		FullInterval: -1,
+		MaxBackoff:   80 * time.Millisecond,
+	})
+	m.client.rto = 5 * time.Millisecond
+	m.client.maxSends = 2
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	for m.MappedAddr() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the NAT rebinds the socket to another port
+	srv.setHandler(natResponse(5))
+	e := waitEvent(t, m, EventMappedAddrChanged)
+	if e.NewAddr.Port != e.OldAddr.Port+5 || !addrEqual(m.MappedAddr(), e.NewAddr) {
+		t.Errorf("unexpected change %v", e)
+	}
+
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet { return nil })
+	waitEvent(t, m, EventServerUnreachable)
+	srv.setHandler(natResponse(5))
+	waitEvent(t, m, EventServerReachable)
+}
+
+func TestMonitorDebounce(t *testing.T) {
+	var events []MonitorEvent
+	m := NewMonitor(MonitorOptions{Debounce: 2, Callback: func(e MonitorEvent) {
+		events = append(events, e)
+	}})
+	a := &net.UDPAddr{IP: testNATIP, Port: 1000}
+	b := &net.UDPAddr{IP: testNATIP, Port: 2000}
+
+	m.observeAddr(a)
+	m.observeAddr(b)
+	m.observeAddr(a)
+	if len(events) != 0 || !addrEqual(m.MappedAddr(), a) {
+		t.Fatalf("a single observation reported: %v", events)
+	}
+	m.observeAddr(b)
+	m.observeAddr(b)
+	if len(events) != 1 || !addrEqual(events[0].NewAddr, b) {
+		t.Errorf("confirmed change not reported: %v", events)
+	}
+
+	m.observeType(NATTypeFullCone)
+	m.observeType(NATTypeSymmetric)
+	m.observeType(NATTypeSymmetric)
+	if len(events) != 2 || events[1].NewType != NATTypeSymmetric || events[1].OldType != NATTypeFullCone {
+		t.Errorf("NAT type change not reported: %v", events)
+	}
+	// a change to unknown is a change like any other
+	m.observeType(NATTypeUnknown)
+	m.observeType(NATTypeUnknown)
+	if len(events) != 3 || events[2].NewType != NATTypeUnknown {
+		t.Errorf("NAT type change to unknown not reported: %v", events)
+	}
+}
+
+// stopWithin fails the test when Stop blocks for longer than d.
+func stopWithin(t *testing.T, m *Monitor, d time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(d):
+		t.Fatalf("Stop blocked for more than %v", d)
+	}
+}
+
+func TestMonitorStopNotRunning(t *testing.T) {
+	stopWithin(t, NewMonitor(MonitorOptions{}), time.Second)
+
+	m := NewMonitor(MonitorOptions{Server: "no port"})
+	if err := m.Start(); err == nil {
+		t.Fatal("monitor started on a bad server address")
+	}
+	stopWithin(t, m, time.Second)
+}
+
+func TestMonitorStopDuringFullRun(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet { return nil })
+
+	// the first discovery waits for test I on the RFC 3489 schedule
+	m := NewMonitor(MonitorOptions{Server: srv.udpAddr()})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stopWithin(t, m, time.Second)
+}
@@ -0,0 +1,260 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	defMTUMaxSize      = 9000
+	defMTUFragmentSize = 4000
+	// every path carries this datagram size (RFC 791 reassembly minimum)
+	minMTUSize = 576
+	// a lost probe is ambiguous anyway, do not wait for the 9 sends
+	mtuProbeSends = 3
+
+	ipv4UDPHeaderSize = 20 + 8
+	ipv6UDPHeaderSize = 40 + 8
+)
+
+var errDontFragment = errors.New("setting DF is only supported on Linux")
+
+// FragmentResult tells whether fragmented datagrams cross the path.
+type FragmentResult int
+
+// Fragmentation outcomes.
+const (
+	FragmentsUnknown FragmentResult = iota
+	FragmentsPass
+	FragmentsDropped
+)
+
+var fragmentResultDescription = map[FragmentResult]string{
+	FragmentsUnknown: "unknown",
+	FragmentsPass:    "fragments pass",
+	FragmentsDropped: "fragments dropped",
+}
+
+func (r FragmentResult) String() string {
+	if s, ok := fragmentResultDescription[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// MTUOptions configures ProbeMTU, zero values take the defaults. Sizes are
+// IP datagram sizes, headers included.
+type MTUOptions struct {
+	// MaxSize is the upper bound of the path MTU search, 9000 by default.
+	MaxSize int
+	// FragmentSize is the size probed without DF, 4000 by default, above
+	// the MTU of most paths so that it gets fragmented.
+	FragmentSize int
+}
+
+// MTUProbe is one padded Binding request.
+type MTUProbe struct {
+	Size int
+	DF   bool
+	// ResponseSize is the size of the response datagram, 0 when no
+	// response arrived.
+	ResponseSize int
+}
+
+// MTUResult is the outcome of ProbeMTU.
+type MTUResult struct {
+	Probes []MTUProbe
+	// PathMTU is the largest datagram answered with DF set, 0 when DF can
+	// not be set on this system.
+	PathMTU int
+	// MaxResponse is the largest response datagram received. It exceeds a
+	// few hundred bytes only with servers echoing PADDING.
+	MaxResponse int
+	// PaddedResponses tells the server echoes PADDING in its responses, so
+	// that the fragments were probed in both directions.
+	PaddedResponses bool
+	// Fragments is the fate of the datagram of FragmentSize sent without
+	// DF, unknown when the path MTU is at least as large.
+	Fragments FragmentResult
+}
+
+func (r *MTUResult) String() string {
+	var b strings.Builder
+	if r.PathMTU > 0 {
+		fmt.Fprintf(&b, "Path MTU: %d\n", r.PathMTU)
+	} else {
+		b.WriteString("Path MTU: not measured\n")
+	}
+	fmt.Fprintf(&b, "Largest response: %d\n", r.MaxResponse)
+	fmt.Fprintf(&b, "Padded responses: %v\n", r.PaddedResponses)
+	fmt.Fprintf(&b, "Fragmentation: %v", r.Fragments)
+	return b.String()
+}
+
+/*
+ * RFC 5780 7.6: a Binding request padded with PADDING to a given size is
+ * answered if and only if a datagram of this size crosses the path. With
+ * DF set a datagram larger than the path MTU is dropped, or rejected by the
+ * kernel, so a binary search over the size finds the path MTU. Without DF
+ * a datagram larger than it is fragmented, and its answer tells whether
+ * the fragments pass the NATs and firewalls on the path.
+ */
+
+// ProbeMTU measures the path MTU toward the server and checks whether
+// fragmented datagrams get through.
+func (c *Client) ProbeMTU(srvAddrStr string, opts MTUOptions) (*MTUResult, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("MTU probing requires the UDP transport")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defMTUMaxSize
+	}
+	if opts.FragmentSize <= 0 {
+		opts.FragmentSize = defMTUFragmentSize
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	laddr := &net.UDPAddr{IP: c.nLocalAddr.IP}
+	c.release()
+	ipv6 := c.nSrvAddr.IP.To4() == nil
+	header := ipv4UDPHeaderSize
+	if ipv6 {
+		header = ipv6UDPHeaderSize
+	}
+
+	fragConn, err := c.listenMTU(laddr, ipv6, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fragConn.Close()
+	dfConn, err := c.listenMTU(laddr, ipv6, true)
+	if err == errDontFragment {
+		dfConn = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer dfConn.Close()
+	}
+
+	result := &MTUResult{}
+	probe := func(conn net.PacketConn, size int) bool {
+		p := c.probeMTU(conn, size, header)
+		p.DF = conn == dfConn
+		result.Probes = append(result.Probes, p)
+		if p.ResponseSize > result.MaxResponse {
+			result.MaxResponse = p.ResponseSize
+		}
+		return p.ResponseSize > 0
+	}
+
+	if !probe(fragConn, minMTUSize) {
+		return nil, errors.New("the STUN server had NO answer:" + c.nSrvAddr.String())
+	}
+	result.PaddedResponses = result.MaxResponse >= minMTUSize/2
+
+	if dfConn != nil {
+		result.PathMTU = searchMTU(minMTUSize, opts.MaxSize, func(size int) bool {
+			return probe(dfConn, size)
+		})
+	}
+	if result.PathMTU == 0 || opts.FragmentSize > result.PathMTU {
+		result.Fragments = FragmentsDropped
+		if probe(fragConn, opts.FragmentSize) {
+			result.Fragments = FragmentsPass
+		}
+	}
+	return result, nil
+}
+
+// searchMTU binary searches, over multiples of 4, the largest size the
+// probe passes between lo, which passes, and max.
+func searchMTU(lo, max int, probe func(size int) bool) int {
+	if !probe(lo) {
+		// even the minimum is dropped with DF, do not guess
+		return 0
+	}
+	if probe(max) {
+		return max
+	}
+	hi := max
+	for hi-lo > 4 {
+		mid := (lo + (hi-lo)/2) &^ 3
+		if probe(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// listenMTU opens a socket with DF set or cleared.
+func (c *Client) listenMTU(laddr *net.UDPAddr, ipv6 bool, df bool) (net.PacketConn, error) {
+	conn, err := c.listenUDP(laddr)
+	if err != nil {
+		return nil, err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("MTU probing requires a UDP socket")
+	}
+	rc, err := udp.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = setDontFragment(fd, ipv6, df)
+	}); err != nil {
+		serr = err
+	}
+	if serr != nil {
+		conn.Close()
+		return nil, serr
+	}
+	return conn, nil
+}
+
+// probeMTU sends one Binding request padded to a datagram of size bytes.
+// A send rejected by the kernel, because of DF, is a probe without answer.
+func (c *Client) probeMTU(conn net.PacketConn, size int, header int) MTUProbe {
+	a := c.newAgent(conn)
+	defer a.close()
+	if c.maxSends <= 0 {
+		a.setMaxSends(mtuProbeSends)
+	}
+
+	rqst := buildBindingRequestRFC5389(false, false)
+	padding := (size - header - 20 - 4) &^ 3
+	if padding > 0 {
+		rqst.addAttribute(*newAttribute(attributePadding, make([]byte, padding)))
+	}
+	reply, err := a.do(rqst, c.nSrvAddr, func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	})
+	p := MTUProbe{Size: size}
+	if err == nil && reply != nil {
+		p.ResponseSize = len(reply.raw) + header
+	}
+	return p
+}
@@ -0,0 +1,76 @@
+package stun
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// paddedResponse answers the requests up to max bytes, echoing PADDING.
+func paddedResponse(max int) func(req *packet, from *net.UDPAddr) *packet {
+	return func(req *packet, from *net.UDPAddr) *packet {
+		if len(req.raw) > max {
+			return nil
+		}
+		resp := bindingResponse(req, from)
+		if pad := req.findAttr(attributePadding); pad != nil && resp != nil {
+			resp.addAttribute(*newAttribute(attributePadding, pad.value))
+		}
+		return resp
+	}
+}
+
+func TestProbeMTU(t *testing.T) {
+	srv := newTestServer(t)
+	/*
+	 * the server plays a path carrying datagrams of 1428 bytes, a request
+	 * of 1400 bytes, and dropping the fragments
+	 */
+	srv.setHandler(paddedResponse(1400))
+	client := NewClient()
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 2
+	r, err := client.ProbeMTU(srv.udpAddr(), MTUOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.PaddedResponses || r.MaxResponse < 1400 {
+		t.Errorf("padded responses %v, largest %d", r.PaddedResponses, r.MaxResponse)
+	}
+	if runtime.GOOS == "linux" && r.PathMTU != 1428 {
+		t.Errorf("path MTU %d, expect 1428", r.PathMTU)
+	}
+	if r.Fragments != FragmentsDropped {
+		t.Errorf("%v, expect %v", r.Fragments, FragmentsDropped)
+	}
+
+	srv.setHandler(paddedResponse(maxPacketSize))
+	r, err = client.ProbeMTU(srv.udpAddr(), MTUOptions{MaxSize: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && r.PathMTU != 1500 {
+		t.Errorf("path MTU %d, expect the 1500 bound", r.PathMTU)
+	}
+	if r.Fragments != FragmentsPass || r.MaxResponse < defMTUFragmentSize {
+		t.Errorf("%v with a largest response of %d, expect %v", r.Fragments, r.MaxResponse, FragmentsPass)
+	}
+}
+
+func TestSearchMTU(t *testing.T) {
+	probes := 0
+	mtu := searchMTU(minMTUSize, defMTUMaxSize, func(size int) bool {
+		probes++
+		return size <= 1492
+	})
+	if mtu != 1492 {
+		t.Errorf("path MTU %d, expect 1492", mtu)
+	}
+	if probes > 16 {
+		t.Errorf("%d probes", probes)
+	}
+	if mtu := searchMTU(minMTUSize, defMTUMaxSize, func(int) bool { return false }); mtu != 0 {
+		t.Errorf("path MTU %d when nothing passes", mtu)
+	}
+}
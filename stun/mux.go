@@ -0,0 +1,288 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+   RFC 7983 demultiplexes the protocols sharing a socket on the first byte
+   of each datagram:
+
+                    +----------------+
+                    |        [0..3] -+--> forward to STUN
+                    |                |
+                    |      [16..19] -+--> forward to ZRTP
+                    |                |
+        packet -->  |      [20..63] -+--> forward to DTLS
+                    |                |
+                    |      [64..79] -+--> forward to TURN Channel
+                    |                |
+                    |    [128..191] -+--> forward to RTP/RTCP
+                    +----------------+
+
+   Only STUN is told apart here, everything else belongs to the application.
+*/
+
+// queued datagrams per virtual connection, a full queue drops new datagrams
+// like a full socket buffer would
+const muxQueueSize = 64
+
+// the read buffer of the shared socket holds any UDP datagram, the
+// application side carries RTP and DTLS records larger than STUN messages
+const muxBufferSize = 64 * 1024
+
+// Mux shares a PacketConn between STUN transactions and an application.
+// Datagrams classified as STUN are read from STUNConn, everything else from
+// AppConn. Both virtual connections write to the shared socket.
+type Mux struct {
+	conn               net.PacketConn
+	requireFingerprint bool
+
+	stun *muxConn
+	app  *muxConn
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// MuxOption configures a Mux created by NewMux.
+type MuxOption func(m *Mux)
+
+// WithFingerprintCheck only classifies datagrams closed by a valid
+// FINGERPRINT attribute as STUN.
+func WithFingerprintCheck() MuxOption {
+	return func(m *Mux) {
+		m.requireFingerprint = true
+	}
+}
+
+// NewMux starts demultiplexing conn. The Mux owns the read side of conn from
+// now on, the application must only read from AppConn.
+func NewMux(conn net.PacketConn, opts ...MuxOption) *Mux {
+	m := &Mux{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.stun = newMuxConn(m)
+	m.app = newMuxConn(m)
+	go m.readLoop()
+	return m
+}
+
+// STUNConn returns the virtual connection carrying the STUN datagrams.
+func (m *Mux) STUNConn() net.PacketConn {
+	return m.stun
+}
+
+// AppConn returns the virtual connection carrying all other datagrams.
+func (m *Mux) AppConn() net.PacketConn {
+	return m.app
+}
+
+// Close closes the shared socket and both virtual connections.
+func (m *Mux) Close() error {
+	err := m.conn.Close()
+	m.shutdown(net.ErrClosed)
+	return err
+}
+
+func (m *Mux) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+}
+
+func (m *Mux) readLoop() {
+	buf := make([]byte, muxBufferSize)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			m.shutdown(err)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if m.isSTUN(data) {
+			m.stun.deliver(data, addr)
+		} else {
+			m.app.deliver(data, addr)
+		}
+	}
+}
+
+// isSTUN classifies a datagram by the first byte range of RFC 7983, the
+// header length and the magic cookie, and optionally the FINGERPRINT.
+func (m *Mux) isSTUN(data []byte) bool {
+	if len(data) < 20 || data[0] > 3 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || length+20 != len(data) {
+		return false
+	}
+	cookie := binary.BigEndian.Uint32(data[4:8])
+	if cookie != magicCookie && cookie != magicCookieRFC5389 {
+		return false
+	}
+	if m.requireFingerprint {
+		return checkFingerprint(data)
+	}
+	return true
+}
+
+type muxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// muxConn is one virtual connection of a Mux.
+type muxConn struct {
+	mux *Mux
+	ch  chan muxPacket
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// closed and replaced whenever the read deadline changes, to wake up
+	// a blocked ReadFrom
+	deadlineCh chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxConn(m *Mux) *muxConn {
+	return &muxConn{
+		mux:        m,
+		ch:         make(chan muxPacket, muxQueueSize),
+		deadlineCh: make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *muxConn) deliver(data []byte, addr net.Addr) {
+	select {
+	case <-c.closed:
+	case c.ch <- muxPacket{data: data, addr: addr}:
+	default:
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineCh
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-c.ch:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.data), p.addr, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-c.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-c.mux.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, c.mux.err
+		}
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.mux.conn.WriteTo(b, addr)
+}
+
+// Close closes the virtual connection only, the shared socket stays open
+// until the Mux is closed.
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
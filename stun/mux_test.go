@@ -0,0 +1,81 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxClassify(t *testing.T) {
+	m := &Mux{}
+	pkt := buildBindingRequest(false, false)
+	if !m.isSTUN(pkt.serialize()) {
+		t.Errorf("Binding request not classified as STUN")
+	}
+	dtls := append([]byte{22}, make([]byte, 40)...)
+	if m.isSTUN(dtls) {
+		t.Errorf("DTLS record classified as STUN")
+	}
+	broken := pkt.serialize()
+	broken[3]++
+	if m.isSTUN(broken) {
+		t.Errorf("message with a wrong length classified as STUN")
+	}
+
+	m.requireFingerprint = true
+	if m.isSTUN(pkt.serialize()) {
+		t.Errorf("message without FINGERPRINT classified as STUN")
+	}
+	pkt.addFingerprint()
+	if !m.isSTUN(pkt.serialize()) {
+		t.Errorf("message with FINGERPRINT not classified as STUN")
+	}
+	data := pkt.serialize()
+	data[len(data)-1] ^= 0xff
+	if m.isSTUN(data) {
+		t.Errorf("message with a bad FINGERPRINT classified as STUN")
+	}
+}
+
+func TestMuxSharedSocket(t *testing.T) {
+	srv := newTestServer(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	mux := NewMux(conn)
+	defer mux.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer peer.Close()
+	// larger than any STUN message, the application side gets it whole
+	appData := bytes.Repeat([]byte("application datagram "), 200)
+	if _, err := peer.WriteTo(appData, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(WithPacketConn(mux.STUNConn()))
+	if _, err := client.Binding(srv.udpAddr()); err != nil {
+		t.Fatalf("binding over the mux error: %v", err)
+	}
+
+	app := mux.AppConn()
+	_ = app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8192)
+	n, from, err := app.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("application datagram lost: %v", err)
+	}
+	if !bytes.Equal(buf[:n], appData) || from.String() != peer.LocalAddr().String() {
+		t.Errorf("application datagram mismatch: %q from %v", buf[:n], from)
+	}
+
+	_ = app.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := app.ReadFrom(buf); err == nil {
+		t.Errorf("STUN response leaked to the application")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"net"
+)
+
+/*
+ * RFC 6146 and RFC 6147: an IPv6-only host reaches IPv4 servers through a
+ * NAT64, at IPv6 addresses the DNS64 synthesizes by embedding the IPv4
+ * address in a prefix, the well-known 64:ff9b::/96 or one of the network.
+ * RFC 7050: the prefix is learned from the AAAA records synthesized for
+ * ipv4only.arpa, whose only A records are 192.0.0.170 and 192.0.0.171.
+ */
+
+const ipv4OnlyName = "ipv4only.arpa"
+
+var (
+	ipv4OnlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+	// WellKnownNAT64Prefix is the prefix of RFC 6052.
+	WellKnownNAT64Prefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+	// the prefix lengths of RFC 6052 2.2, the longest first
+	nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+)
+
+// DiscoverNAT64Prefixes learns the NAT64 prefixes of the network from the
+// DNS64, it returns none when the DNS does not synthesize AAAA records. A
+// nil resolver is net.DefaultResolver.
+func DiscoverNAT64Prefixes(ctx context.Context, r Resolver) ([]*net.IPNet, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, ipv4OnlyName)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []*net.IPNet
+	for _, addr := range addrs {
+		prefix := nat64Prefix(addr.IP)
+		if prefix == nil {
+			continue
+		}
+		dup := false
+		for _, p := range prefixes {
+			dup = dup || p.String() == prefix.String()
+		}
+		if !dup {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// nat64Prefix is the prefix ip was synthesized with for ipv4only.arpa, nil
+// when ip does not embed one of its IPv4 addresses.
+func nat64Prefix(ip net.IP) *net.IPNet {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	for _, n := range nat64PrefixLengths {
+		embedded := extractIPv4(ip, n)
+		for _, known := range ipv4OnlyAddrs {
+			if embedded.Equal(known) {
+				mask := net.CIDRMask(n, 128)
+				return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+			}
+		}
+	}
+	return nil
+}
+
+// SynthesizeNAT64 embeds the IPv4 address ip in prefix like a DNS64 does,
+// it returns nil when the prefix length is not one of RFC 6052.
+func SynthesizeNAT64(prefix *net.IPNet, ip net.IP) net.IP {
+	ip4 := ip.To4()
+	n, bits := prefix.Mask.Size()
+	if ip4 == nil || bits != 128 || !validNAT64PrefixLength(n) {
+		return nil
+	}
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.Mask(prefix.Mask))
+	i := n / 8
+	for _, b := range ip4 {
+		// bits 64 to 71 are reserved and stay zero
+		if i == 8 {
+			i++
+		}
+		out[i] = b
+		i++
+	}
+	return out
+}
+
+// extractIPv4 is the IPv4 address embedded in the IPv6 ip with a prefix of
+// n bits.
+func extractIPv4(ip net.IP, n int) net.IP {
+	var ip4 [net.IPv4len]byte
+	i := n / 8
+	for k := range ip4 {
+		if i == 8 {
+			i++
+		}
+		ip4[k] = ip[i]
+		i++
+	}
+	return net.IPv4(ip4[0], ip4[1], ip4[2], ip4[3])
+}
+
+func validNAT64PrefixLength(n int) bool {
+	for _, l := range nat64PrefixLengths {
+		if l == n {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNAT64Addr tells whether ip is synthesized with one of the prefixes or
+// the well-known prefix.
+func IsNAT64Addr(ip net.IP, prefixes []*net.IPNet) bool {
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+	if WellKnownNAT64Prefix.Contains(ip) {
+		return true
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestSynthesizeNAT64(t *testing.T) {
+	// the examples of RFC 6052 2.4 for 192.0.2.33
+	ip := net.IPv4(192, 0, 2, 33)
+	cases := []struct {
+		prefix string
+		expect string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tc := range cases {
+		_, prefix, _ := net.ParseCIDR(tc.prefix)
+		synth := SynthesizeNAT64(prefix, ip)
+		if !synth.Equal(net.ParseIP(tc.expect)) {
+			t.Errorf("%s: synthesized %v, expect %s", tc.prefix, synth, tc.expect)
+			continue
+		}
+		n, _ := prefix.Mask.Size()
+		if back := extractIPv4(synth, n); !back.Equal(ip) {
+			t.Errorf("%s: extracted %v", tc.prefix, back)
+		}
+		if !IsNAT64Addr(synth, []*net.IPNet{prefix}) {
+			t.Errorf("%s: %v not a NAT64 address", tc.prefix, synth)
+		}
+	}
+	_, bad, _ := net.ParseCIDR("2001:db8::/80")
+	if synth := SynthesizeNAT64(bad, ip); synth != nil {
+		t.Errorf("synthesized %v with a /80", synth)
+	}
+	if !IsNAT64Addr(net.ParseIP("64:ff9b::c000:221"), nil) || IsNAT64Addr(ip, nil) {
+		t.Errorf("well-known prefix not recognized")
+	}
+}
+
+func TestDiscoverNAT64Prefixes(t *testing.T) {
+	d := newTestDNS(t, nil, map[string]net.IP{ipv4OnlyName: net.ParseIP("2001:db8:122:344::c000:aa")})
+	prefixes, err := DiscoverNAT64Prefixes(context.Background(), d.resolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != 1 || prefixes[0].String() != "2001:db8:122:344::/96" {
+		t.Errorf("prefixes %v, expect 2001:db8:122:344::/96", prefixes)
+	}
+
+	// without DNS64 only the A records come back
+	d = newTestDNS(t, nil, map[string]net.IP{ipv4OnlyName: ipv4OnlyAddrs[0]})
+	prefixes, err = DiscoverNAT64Prefixes(context.Background(), d.resolver())
+	if err != nil || len(prefixes) != 0 {
+		t.Errorf("prefixes %v, error %v without DNS64", prefixes, err)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"net"
+)
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(c *Client)
+
+// WithLocalIP pins the source address of the client socket instead of
+// letting the kernel pick it from the route to the server.
+func WithLocalIP(ip net.IP) ClientOption {
+	return func(c *Client) {
+		c.localIP = ip
+	}
+}
+
+// WithLocalPort binds the client socket to a fixed local port.
+func WithLocalPort(port int) ClientOption {
+	return WithLocalPortRange(port, port)
+}
+
+// WithLocalPortRange binds the client socket to the first free port
+// in [min, max].
+func WithLocalPortRange(min, max int) ClientOption {
+	return func(c *Client) {
+		c.localPortMin = min
+		c.localPortMax = max
+	}
+}
+
+// WithInterface binds the client socket to the named network interface.
+// On Linux the socket is bound with SO_BINDTODEVICE, elsewhere only the
+// interface address is used as source address.
+func WithInterface(name string) ClientOption {
+	return func(c *Client) {
+		c.ifName = name
+	}
+}
+
+// WithPacketConn runs the client over an existing socket, for instance the
+// STUNConn of a Mux, instead of opening its own. The socket is not closed
+// by the client, but its read deadline is cleared at the end of every call.
+func WithPacketConn(conn net.PacketConn) ClientOption {
+	return func(c *Client) {
+		c.sharedConn = conn
+	}
+}
+
+// WithFallbackServers names ordinary STUN servers used when the discovery
+// server does not support CHANGE-REQUEST: the mapping behavior is then
+// found by comparing the mapped addresses they report for the same socket.
+func WithFallbackServers(addrs ...string) ClientOption {
+	return func(c *Client) {
+		c.fallbacks = append(c.fallbacks, addrs...)
+	}
+}
@@ -2,8 +2,10 @@ package stun
 
 import (
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"math"
 	"net"
 )
@@ -47,10 +49,12 @@ type packet struct {
 	transID    []byte // 4 serialize magic cookie + 12 serialize transaction id
 	attributes []attribute
 	orgHost    *net.UDPAddr
+	raw        []byte // the message as received
 }
 
 const (
 	msgTypeBindingRequest       = 0x0001
+	msgTypeBindingIndication    = 0x0011
 	msgTypeBindingResponse      = 0x0101
 	msgTypeBindingErrorResponse = 0x0111
 	msgTypeSharedSecretRequest  = 0x0002
@@ -61,6 +65,9 @@ const (
 // local defined magic Cookie
 const magicCookie = 0xA2400227
 
+// magic cookie of RFC 5389 messages
+const magicCookieRFC5389 = 0x2112A442
+
 func newPacket() (*packet, error) {
 	v := new(packet)
 	v.transID = make([]byte, 16)
@@ -85,6 +92,7 @@ func parsePackage(pkgData []byte) (*packet, error) {
 	pkt.types = binary.BigEndian.Uint16(pkgData[0:2])
 	pkt.length = binary.BigEndian.Uint16(pkgData[2:4])
 	pkt.transID = pkgData[4:20]
+	pkt.raw = pkgData
 	pkt.attributes = make([]attribute, 0, 10)
 	pkgData = pkgData[20:]
 	for pos := uint16(0); pos+4 < uint16(len(pkgData)); {
@@ -96,6 +104,7 @@ func parsePackage(pkgData []byte) (*packet, error) {
 		}
 		value := pkgData[pos+4 : end]
 		attribute := newAttribute(types, value)
+		attribute.length = length
 		pkt.addAttribute(*attribute)
 		pos += align(length) + 4
 	}
@@ -124,6 +133,50 @@ func (v *packet) serialize() []byte {
 	return packetBytes
 }
 
+// addMessageIntegrity signs the packet with the HMAC-SHA1 of key, only
+// FINGERPRINT may be added after it.
+func (v *packet) addMessageIntegrity(key []byte) {
+	v.length += 4 + sha1.Size
+	mac := messageIntegrity(v.serialize(), key)
+	v.length -= 4 + sha1.Size
+	v.addAttribute(*newAttribute(attributeMessageIntegrity, mac))
+}
+
+// findAttr returns the first attribute of a type.
+func (v *packet) findAttr(types uint16) *attribute {
+	for i := range v.attributes {
+		if v.attributes[i].types == types {
+			return &v.attributes[i]
+		}
+	}
+	return nil
+}
+
+func (v *packet) getUsername() string {
+	if attr := v.findAttr(attributeUsername); attr != nil {
+		return string(attr.value[:attr.length])
+	}
+	return ""
+}
+
+func (v *packet) getErrorCode() int {
+	if attr := v.findAttr(attributeErrorCode); attr != nil {
+		return attr.errorCode()
+	}
+	return 0
+}
+
+// addFingerprint closes the packet with a FINGERPRINT attribute, it must be
+// the last attribute added.
+func (v *packet) addFingerprint() {
+	v.length += 8
+	crc := crc32.ChecksumIEEE(v.serialize()) ^ fingerprintXOR
+	v.length -= 8
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, crc)
+	v.addAttribute(*newAttribute(attributeFingerprint, value))
+}
+
 func (v *packet) getSourceAddr() *net.UDPAddr {
 	return v.findAttrAddr(attributeSourceAddress)
 }
@@ -136,6 +189,37 @@ func (v *packet) getChangedAddr() *net.UDPAddr {
 	return v.findAttrAddr(attributeChangedAddress)
 }
 
+func (v *packet) getXorMappedAddr() *net.UDPAddr {
+	for _, attr := range v.attributes {
+		if attr.types == attributeXorMappedAddress {
+			return attr.xorAddr(v.transID)
+		}
+	}
+	return nil
+}
+
+func (v *packet) getOtherAddr() *net.UDPAddr {
+	return v.findAttrAddr(attributeOtherAddress)
+}
+
+// getReflexiveAddr returns the XOR-MAPPED-ADDRESS of RFC 5389 servers, and
+// the MAPPED-ADDRESS of the older ones.
+func (v *packet) getReflexiveAddr() *net.UDPAddr {
+	if addr := v.getXorMappedAddr(); addr != nil {
+		return addr
+	}
+	return v.getMappedAddr()
+}
+
+// getAlternateAddr returns the OTHER-ADDRESS of RFC 5780 servers, and the
+// CHANGED-ADDRESS of RFC 3489 ones.
+func (v *packet) getAlternateAddr() *net.UDPAddr {
+	if addr := v.getOtherAddr(); addr != nil {
+		return addr
+	}
+	return v.getChangedAddr()
+}
+
 func (v *packet) findAttrAddr(attribute uint16) *net.UDPAddr {
 	for _, attr := range v.attributes {
 		if attr.types == attribute {
@@ -3,6 +3,7 @@ package stun
 import (
 	"crypto/rand"
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -70,3 +71,22 @@ func TestNewPacket(t *testing.T) {
 		t.Errorf("newPacket error")
 	}
 }
+
+func TestXorMappedAddress(t *testing.T) {
+	for _, s := range []string{"192.0.2.1:32853", "[2001:db8:1234:5678:11:2233:4455:6677]:32853"} {
+		addr, _ := net.ResolveUDPAddr("udp", s)
+		pkt := buildBindingRequestRFC5389(false, false)
+		pkt.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, pkt.transID))
+
+		parsed, err := parsePackage(pkt.serialize())
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if got := parsed.getXorMappedAddr(); !addrEqual(got, addr) {
+			t.Errorf("XOR-MAPPED-ADDRESS mismatch: %v != %v", got, addr)
+		}
+		if got := parsed.getMappedAddr(); got != nil {
+			t.Errorf("unexpected MAPPED-ADDRESS %v", got)
+		}
+	}
+}
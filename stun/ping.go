@@ -0,0 +1,267 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defPingInterval = time.Second
+	defPingTimeout  = 2 * time.Second
+)
+
+// PingOptions configures Ping, zero values take the defaults.
+type PingOptions struct {
+	// Count is the number of requests, 0 pings until the context is done.
+	Count int
+	// Interval between two requests, 1s by default.
+	Interval time.Duration
+	// Timeout after which a request without response is lost, 2s by
+	// default. Requests are not retransmitted.
+	Timeout time.Duration
+	// OnReply, when not nil, is called as every request completes.
+	OnReply func(r PingReply)
+}
+
+// PingReply is the outcome of one request.
+type PingReply struct {
+	Seq        int
+	RTT        time.Duration
+	MappedAddr *net.UDPAddr
+	Lost       bool
+	// AddrChanged tells the mapped address differs from the response to
+	// the previous request. OnReply sees it against the responses received
+	// so far, the replies of PingStats against all of them.
+	AddrChanged bool
+	// Err is the send error of a lost request, nil on a timeout.
+	Err error
+}
+
+func (r PingReply) String() string {
+	if r.Lost {
+		if r.Err != nil {
+			return fmt.Sprintf("seq=%d lost: %v", r.Seq, r.Err)
+		}
+		return fmt.Sprintf("seq=%d timeout", r.Seq)
+	}
+	s := fmt.Sprintf("seq=%d mapped=%v time=%.3f ms", r.Seq, r.MappedAddr, durationMs(r.RTT))
+	if r.AddrChanged {
+		s += " (mapped address changed)"
+	}
+	return s
+}
+
+// PingStats sums up a Ping.
+type PingStats struct {
+	Server   string
+	Sent     int
+	Received int
+	// Loss is the percentage of requests lost.
+	Loss float64
+
+	Min  time.Duration
+	Avg  time.Duration
+	Max  time.Duration
+	Mdev time.Duration
+	// Jitter is the mean difference between the RTTs of consecutive
+	// responses.
+	Jitter time.Duration
+
+	// MappedAddrs lists the mapped addresses in the order they were seen.
+	MappedAddrs []*net.UDPAddr
+	Replies     []PingReply
+}
+
+func (s *PingStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s STUN ping statistics ---\n", s.Server)
+	fmt.Fprintf(&b, "%d requests sent, %d responses received, %.1f%% loss", s.Sent, s.Received, s.Loss)
+	if s.Received > 0 {
+		fmt.Fprintf(&b, "\nrtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms, jitter %.3f ms",
+			durationMs(s.Min), durationMs(s.Avg), durationMs(s.Max), durationMs(s.Mdev), durationMs(s.Jitter))
+	}
+	if len(s.MappedAddrs) > 1 {
+		addrs := make([]string, len(s.MappedAddrs))
+		for i, addr := range s.MappedAddrs {
+			addrs[i] = addr.String()
+		}
+		fmt.Fprintf(&b, "\nmapped address changed: %s", strings.Join(addrs, " -> "))
+	}
+	return b.String()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Ping sends a Binding request every interval, from one socket so that the
+// changes of the mapping show, and measures the round trips like ping.
+func (c *Client) Ping(ctx context.Context, srvAddrStr string, opts PingOptions) (*PingStats, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("ping requires the UDP transport")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defPingInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defPingTimeout
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	// one send per request, lost after the timeout
+	c.agent.rto = opts.Timeout
+	c.agent.setMaxSends(1)
+
+	stats := &PingStats{Server: c.nSrvAddr.String()}
+	var mu sync.Mutex
+	lastSeq := 0
+	record := func(r PingReply) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !r.Lost {
+			// the responses may come out of order when the RTT exceeds
+			// the interval
+			if prev := previousReply(stats.Replies, r.Seq); prev != nil {
+				r.AddrChanged = !addrEqual(prev.MappedAddr, r.MappedAddr)
+			}
+			if r.Seq > lastSeq {
+				lastSeq = r.Seq
+				c.nMappedAddr = r.MappedAddr
+			}
+		}
+		stats.Replies = append(stats.Replies, r)
+		if opts.OnReply != nil {
+			opts.OnReply(r)
+		}
+	}
+
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for seq := 1; opts.Count <= 0 || seq <= opts.Count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		c.ping(seq, func(r PingReply) {
+			record(r)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	sort.Slice(stats.Replies, func(i, j int) bool {
+		return stats.Replies[i].Seq < stats.Replies[j].Seq
+	})
+	stats.summarize()
+	return stats, nil
+}
+
+// ping sends one request, done is called with its outcome.
+func (c *Client) ping(seq int, done func(r PingReply)) {
+	rqst := buildBindingRequestRFC5389(false, false)
+	fchk := func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	}
+	sent := time.Now()
+	c.agent.start(rqst, c.nSrvAddr, fchk, func(p *packet, err error) {
+		r := PingReply{Seq: seq}
+		if p == nil {
+			r.Lost = true
+			r.Err = err
+		} else {
+			r.RTT = time.Since(sent)
+			r.MappedAddr = p.getReflexiveAddr()
+		}
+		done(r)
+	})
+}
+
+// previousReply is the response of replies to the latest request before
+// seq, nil when none came.
+func previousReply(replies []PingReply, seq int) *PingReply {
+	var prev *PingReply
+	for i := range replies {
+		r := &replies[i]
+		if !r.Lost && r.Seq < seq && (prev == nil || r.Seq > prev.Seq) {
+			prev = r
+		}
+	}
+	return prev
+}
+
+// summarize computes the statistics of the replies, sorted by sequence.
+func (s *PingStats) summarize() {
+	s.Sent = len(s.Replies)
+	var sum, sum2, jitter float64
+	var prev *PingReply
+	for i := range s.Replies {
+		r := &s.Replies[i]
+		if r.Lost {
+			continue
+		}
+		s.Received++
+		if s.Received == 1 || r.RTT < s.Min {
+			s.Min = r.RTT
+		}
+		if r.RTT > s.Max {
+			s.Max = r.RTT
+		}
+		rtt := float64(r.RTT)
+		sum += rtt
+		sum2 += rtt * rtt
+		r.AddrChanged = false
+		if prev != nil {
+			jitter += math.Abs(rtt - float64(prev.RTT))
+			r.AddrChanged = !addrEqual(prev.MappedAddr, r.MappedAddr)
+		}
+		if n := len(s.MappedAddrs); n == 0 || !addrEqual(s.MappedAddrs[n-1], r.MappedAddr) {
+			s.MappedAddrs = append(s.MappedAddrs, r.MappedAddr)
+		}
+		prev = r
+	}
+	if s.Sent > 0 {
+		s.Loss = 100 * float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	if s.Received == 0 {
+		return
+	}
+	n := float64(s.Received)
+	avg := sum / n
+	s.Avg = time.Duration(avg)
+	// the mdev of ping, the standard deviation of the RTTs
+	s.Mdev = time.Duration(math.Sqrt(math.Max(sum2/n-avg*avg, 0)))
+	if s.Received > 1 {
+		s.Jitter = time.Duration(jitter / (n - 1))
+	}
+}
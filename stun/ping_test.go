@@ -0,0 +1,123 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	requests := 0
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		/*
+		 * the third request is lost, the mapping changes from the fifth on
+		 */
+		switch {
+		case requests == 3:
+			return nil
+		case requests >= 5:
+			return natResponse(4)(req, from)
+		}
+		return natResponse(0)(req, from)
+	})
+
+	var replies []PingReply
+	client := NewClient()
+	stats, err := client.Ping(context.Background(), srv.udpAddr(), PingOptions{
+		Count:    6,
+		Interval: 10 * time.Millisecond,
+		Timeout:  200 * time.Millisecond,
+		OnReply: func(r PingReply) {
+			replies = append(replies, r)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 6 || stats.Sent != 6 || stats.Received != 5 {
+		t.Fatalf("%d replies, stats %v", len(replies), stats)
+	}
+	if !stats.Replies[2].Lost || stats.Loss < 16 || stats.Loss > 17 {
+		t.Errorf("loss %.1f%%, replies %v", stats.Loss, stats.Replies)
+	}
+	if len(stats.MappedAddrs) != 2 || stats.MappedAddrs[1].Port != stats.MappedAddrs[0].Port+4 {
+		t.Errorf("mapped addresses %v", stats.MappedAddrs)
+	}
+	if !stats.Replies[4].AddrChanged || stats.Replies[5].AddrChanged {
+		t.Errorf("address changes not reported on the fifth reply only: %v", stats.Replies)
+	}
+	if stats.Min <= 0 || stats.Min > stats.Avg || stats.Avg > stats.Max {
+		t.Errorf("rtt %v/%v/%v", stats.Min, stats.Avg, stats.Max)
+	}
+}
+
+func TestPingCancel(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setHandler(natResponse(0))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stats, err := NewClient().Ping(ctx, srv.udpAddr(), PingOptions{Interval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sent == 0 || stats.Sent > 6 || stats.Received != stats.Sent {
+		t.Errorf("stats %v", stats)
+	}
+}
+
+func TestPingStatsSummarize(t *testing.T) {
+	ms := time.Millisecond
+	addr := &net.UDPAddr{IP: testNATIP, Port: 40000}
+	s := &PingStats{Replies: []PingReply{
+		{Seq: 1, RTT: 10 * ms, MappedAddr: addr},
+		{Seq: 2, Lost: true},
+		{Seq: 3, RTT: 30 * ms, MappedAddr: addr},
+		{Seq: 4, RTT: 20 * ms, MappedAddr: addr},
+	}}
+	s.summarize()
+	if s.Sent != 4 || s.Received != 3 || s.Loss != 25 {
+		t.Errorf("sent %d, received %d, loss %.1f", s.Sent, s.Received, s.Loss)
+	}
+	if s.Min != 10*ms || s.Avg != 20*ms || s.Max != 30*ms {
+		t.Errorf("rtt %v/%v/%v", s.Min, s.Avg, s.Max)
+	}
+	// sqrt((100+900+400)/3 - 400) ms
+	if s.Mdev < 8160*time.Microsecond || s.Mdev > 8170*time.Microsecond {
+		t.Errorf("mdev %v", s.Mdev)
+	}
+	// (20+10)/2 ms
+	if s.Jitter != 15*ms {
+		t.Errorf("jitter %v", s.Jitter)
+	}
+	if len(s.MappedAddrs) != 1 {
+		t.Errorf("mapped addresses %v", s.MappedAddrs)
+	}
+}
+
+func TestPingStatsAddrChangedInSequence(t *testing.T) {
+	a := &net.UDPAddr{IP: testNATIP, Port: 40000}
+	b := &net.UDPAddr{IP: testNATIP, Port: 40004}
+	/*
+	 * the response to 2 came after the one to 3, the flags of completion
+	 * order are wrong
+	 */
+	s := &PingStats{Replies: []PingReply{
+		{Seq: 1, MappedAddr: a},
+		{Seq: 2, MappedAddr: b},
+		{Seq: 3, MappedAddr: b, AddrChanged: true},
+	}}
+	s.summarize()
+	if s.Replies[0].AddrChanged || !s.Replies[1].AddrChanged || s.Replies[2].AddrChanged {
+		t.Errorf("address changes %v", s.Replies)
+	}
+	if len(s.MappedAddrs) != 2 {
+		t.Errorf("mapped addresses %v", s.MappedAddrs)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// PortAllocation is the way a NAT picks the external port of new mappings.
+type PortAllocation int
+
+// Port allocation patterns.
+const (
+	PortAllocationUnknown PortAllocation = iota
+	PortAllocationPreserving
+	PortAllocationContiguous
+	PortAllocationSequential
+	PortAllocationParityPreserving
+	PortAllocationRandom
+)
+
+var portAllocationDescription = map[PortAllocation]string{
+	PortAllocationUnknown:          "Port allocation indeterminacy",
+	PortAllocationPreserving:       "Port preserving",
+	PortAllocationContiguous:       "Contiguous",
+	PortAllocationSequential:       "Sequential",
+	PortAllocationParityPreserving: "Parity preserving",
+	PortAllocationRandom:           "Random",
+}
+
+func (p PortAllocation) String() string {
+	if s, ok := portAllocationDescription[p]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+const (
+	defPortSamples = 8
+	// share of the samples which must follow a pattern to report it
+	portPatternThreshold = 0.6
+	// parity holds by chance for half the samples, it needs more
+	portParityThreshold = 0.9
+	// ports below are never handed out by NATs
+	minDynamicPort = 1024
+)
+
+// PortSample is one mapping opened by the analyser.
+type PortSample struct {
+	LocalPort  int
+	MappedPort int
+	Dest       *net.UDPAddr
+}
+
+// PortAnalysis is the port allocation pattern found in a series of
+// mappings.
+type PortAnalysis struct {
+	Allocation PortAllocation
+	// Delta is the step between consecutive ports of a contiguous or
+	// sequential allocation.
+	Delta int
+	// Confidence is the share of the samples following the pattern.
+	Confidence float64
+	// NextPort is the predicted external port of the next mapping, zero
+	// when it can not be predicted or depends on the local port, see
+	// PredictPort.
+	NextPort int
+	Samples  []PortSample
+}
+
+func (a *PortAnalysis) String() string {
+	s := fmt.Sprintf("Port allocation: %v", a.Allocation)
+	if a.Allocation == PortAllocationSequential || a.Allocation == PortAllocationContiguous {
+		s += fmt.Sprintf(" (delta %d)", a.Delta)
+	}
+	s += fmt.Sprintf(", confidence %.2f", a.Confidence)
+	if a.NextPort != 0 {
+		s += fmt.Sprintf(", next port %d", a.NextPort)
+	}
+	return s
+}
+
+// PredictPort is the predicted external port of the next mapping from a
+// socket bound to localPort, zero when it can not be predicted.
+func (a *PortAnalysis) PredictPort(localPort int) int {
+	if a.Allocation == PortAllocationPreserving {
+		return localPort
+	}
+	return a.NextPort
+}
+
+// AnalyzePorts opens n mappings, each from a new local socket and to the
+// next of the server's addresses in turn (primary, alternate port,
+// alternate IP, alternate IP and port), and classifies the mapped ports.
+// Servers without OTHER-ADDRESS or CHANGED-ADDRESS only get the primary
+// address probed. n defaults to 8.
+func (c *Client) AnalyzePorts(srvAddrStr string, n int) (*PortAnalysis, error) {
+	if c.transport != TransportUDP {
+		return nil, errors.New("port analysis requires the UDP transport")
+	}
+	if n <= 0 {
+		n = defPortSamples
+	}
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	laddr := &net.UDPAddr{IP: c.nLocalAddr.IP}
+	c.release()
+
+	dests := []*net.UDPAddr{c.nSrvAddr}
+	samples := make([]PortSample, 0, n)
+	for i := 0; i < n; i++ {
+		dest := dests[i%len(dests)]
+		sample, alternate, err := c.samplePort(laddr, dest)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && alternate != nil {
+			dests = append(dests,
+				&net.UDPAddr{IP: c.nSrvAddr.IP, Port: alternate.Port},
+				&net.UDPAddr{IP: alternate.IP, Port: c.nSrvAddr.Port},
+				alternate)
+		}
+		samples = append(samples, *sample)
+	}
+	return analyzePorts(samples), nil
+}
+
+// samplePort opens one mapping from a new socket to dest.
+func (c *Client) samplePort(laddr *net.UDPAddr, dest *net.UDPAddr) (*PortSample, *net.UDPAddr, error) {
+	conn, err := c.listenUDP(laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	a := c.newAgent(conn)
+	defer a.close()
+
+	reply, err := a.do(buildBindingRequestRFC5389(false, false), dest, func(p *packet) bool {
+		return p.getReflexiveAddr() != nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply == nil {
+		return nil, nil, errors.New("the STUN server had NO answer:" + dest.String())
+	}
+	sample := &PortSample{
+		LocalPort:  toUDPAddr(conn.LocalAddr()).Port,
+		MappedPort: reply.getReflexiveAddr().Port,
+		Dest:       dest,
+	}
+	return sample, reply.getAlternateAddr(), nil
+}
+
+// analyzePorts classifies the samples, taken in the order they were
+// mapped.
+func analyzePorts(samples []PortSample) *PortAnalysis {
+	a := &PortAnalysis{Samples: samples}
+	if len(samples) < 2 {
+		return a
+	}
+	total := float64(len(samples))
+	last := samples[len(samples)-1]
+
+	preserved, parity := 0, 0
+	for _, s := range samples {
+		if s.MappedPort == s.LocalPort {
+			preserved++
+		}
+		if s.MappedPort%2 == s.LocalPort%2 {
+			parity++
+		}
+	}
+	if float64(preserved)/total >= portPatternThreshold {
+		a.Allocation = PortAllocationPreserving
+		a.Confidence = float64(preserved) / total
+		// the next mapping takes the port of its local socket, which is
+		// only known to the caller, see PredictPort
+		return a
+	}
+
+	// the most frequent step between consecutive mappings
+	steps := make(map[int]int)
+	delta, count := 0, 0
+	for i := 1; i < len(samples); i++ {
+		d := portDelta(samples[i-1].MappedPort, samples[i].MappedPort)
+		steps[d]++
+		if steps[d] > count || steps[d] == count && abs(d) < abs(delta) {
+			delta, count = d, steps[d]
+		}
+	}
+	share := float64(count) / float64(len(samples)-1)
+	if share >= portPatternThreshold {
+		a.Allocation = PortAllocationSequential
+		if delta == 1 {
+			a.Allocation = PortAllocationContiguous
+		}
+		a.Delta = delta
+		a.Confidence = share
+		a.NextPort = nextPort(last.MappedPort, delta)
+		return a
+	}
+
+	if len(samples) >= 4 && float64(parity)/total >= portParityThreshold {
+		a.Allocation = PortAllocationParityPreserving
+		a.Confidence = float64(parity) / total
+		return a
+	}
+
+	a.Allocation = PortAllocationRandom
+	a.Confidence = 1 - share
+	return a
+}
+
+// portDelta is the step from port a to port b, wrapping around the dynamic
+// port range in the shorter direction.
+func portDelta(a, b int) int {
+	span := 65536 - minDynamicPort
+	d := (b - a) % span
+	if d > span/2 {
+		d -= span
+	} else if d < -span/2 {
+		d += span
+	}
+	return d
+}
+
+// nextPort steps from port, wrapping within the dynamic port range.
+func nextPort(port, delta int) int {
+	span := 65536 - minDynamicPort
+	p := (port - minDynamicPort + delta) % span
+	if p < 0 {
+		p += span
+	}
+	return p + minDynamicPort
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package stun
+
+import (
+	"testing"
+)
+
+func portSamples(local, mapped []int) []PortSample {
+	samples := make([]PortSample, len(local))
+	for i := range local {
+		samples[i] = PortSample{LocalPort: local[i], MappedPort: mapped[i]}
+	}
+	return samples
+}
+
+func TestAnalyzePorts(t *testing.T) {
+	cases := []struct {
+		name       string
+		local      []int
+		mapped     []int
+		allocation PortAllocation
+		delta      int
+		next       int
+	}{
+		{"preserving", []int{40001, 40123, 40777, 41000}, []int{40001, 40123, 40777, 41000},
+			PortAllocationPreserving, 0, 0},
+		{"contiguous", []int{40001, 40123, 40777, 41000, 41500}, []int{5000, 5001, 5002, 5003, 5004},
+			PortAllocationContiguous, 1, 5005},
+		{"sequential", []int{40001, 40123, 40777, 41000, 41500}, []int{5000, 5004, 5008, 5030, 5034},
+			PortAllocationSequential, 4, 5038},
+		{"wrapping", []int{40001, 40123, 40777}, []int{65533, 65535, 1025},
+			PortAllocationSequential, 2, 1027},
+		{"parity", []int{40000, 40001, 40002, 40003, 40004}, []int{6000, 23001, 1502, 33333, 9978},
+			PortAllocationParityPreserving, 0, 0},
+		{"random", []int{40000, 40001, 40002, 40003, 40004}, []int{6001, 23000, 1503, 33332, 9977},
+			PortAllocationRandom, 0, 0},
+	}
+	for _, c := range cases {
+		a := analyzePorts(portSamples(c.local, c.mapped))
+		if a.Allocation != c.allocation || a.Delta != c.delta || a.NextPort != c.next {
+			t.Errorf("%s: got %v delta %d next %d, expect %v delta %d next %d",
+				c.name, a.Allocation, a.Delta, a.NextPort, c.allocation, c.delta, c.next)
+		}
+		if a.Confidence <= 0 || a.Confidence > 1 {
+			t.Errorf("%s: confidence %f out of range", c.name, a.Confidence)
+		}
+	}
+}
+
+func TestPredictPort(t *testing.T) {
+	preserving := analyzePorts(portSamples([]int{40001, 40123, 40777}, []int{40001, 40123, 40777}))
+	if p := preserving.PredictPort(42000); p != 42000 {
+		t.Errorf("port preserving prediction %d, expect the local port 42000", p)
+	}
+	contiguous := analyzePorts(portSamples([]int{40001, 40123, 40777}, []int{5000, 5001, 5002}))
+	if p := contiguous.PredictPort(42000); p != 5003 {
+		t.Errorf("contiguous prediction %d, expect 5003", p)
+	}
+}
+
+func TestAnalyzePortsTooFewSamples(t *testing.T) {
+	a := analyzePorts(portSamples([]int{40000}, []int{5000}))
+	if a.Allocation != PortAllocationUnknown {
+		t.Errorf("one sample classified as %v", a.Allocation)
+	}
+}
@@ -0,0 +1,454 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PunchCandidate is what one side of a hole punching tells the other
+// through the signaling.
+type PunchCandidate struct {
+	// HostAddrs are the local addresses of the socket, reachable on the
+	// same network.
+	HostAddrs  []*net.UDPAddr
+	MappedAddr *net.UDPAddr
+	NATType    NATType
+	// NextPort and Delta predict the mapped ports of a symmetric NAT, see
+	// PortAnalysis. NextPort is zero when they can not be predicted.
+	NextPort int
+	Delta    int
+	// Nonce is a random secret of this side, it never goes on the wire:
+	// the nonces of both sides key the HMAC of the handshake packets.
+	Nonce []byte
+}
+
+const punchNonceSize = 16
+
+// NewPunchCandidate describes the local side of a hole punching from the
+// discovery results of its socket. ports may be nil.
+func NewPunchCandidate(local, mapped *net.UDPAddr, nattyp NATType, ports *PortAnalysis) (*PunchCandidate, error) {
+	nonce := make([]byte, punchNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	pc := &PunchCandidate{MappedAddr: mapped, NATType: nattyp, Nonce: nonce}
+	if local != nil && !local.IP.IsUnspecified() {
+		pc.HostAddrs = append(pc.HostAddrs, local)
+	}
+	if ports != nil {
+		pc.NextPort, pc.Delta = ports.NextPort, ports.Delta
+		if local != nil {
+			pc.NextPort = ports.PredictPort(local.Port)
+		}
+	}
+	return pc, nil
+}
+
+// Signaling exchanges the candidates of the two sides of a hole punching,
+// over a channel both trust, which must keep the nonces secret.
+type Signaling interface {
+	Exchange(ctx context.Context, local *PunchCandidate) (*PunchCandidate, error)
+}
+
+// PunchStrategy is the way the probes are addressed.
+type PunchStrategy int
+
+// Punch strategies.
+const (
+	PunchStrategyNone PunchStrategy = iota
+	// PunchStrategyDirect sends to the addresses of the peer.
+	PunchStrategyDirect
+	// PunchStrategyPredict adds the predicted ports of a symmetric peer.
+	PunchStrategyPredict
+)
+
+var punchStrategyDescription = map[PunchStrategy]string{
+	PunchStrategyNone:    "none",
+	PunchStrategyDirect:  "direct",
+	PunchStrategyPredict: "port prediction",
+}
+
+func (s PunchStrategy) String() string {
+	if d, ok := punchStrategyDescription[s]; ok {
+		return d
+	}
+	return "unknown"
+}
+
+// PunchFailure is the reason a hole punching failed.
+type PunchFailure int
+
+// Punch failures.
+const (
+	PunchErrSignaling PunchFailure = iota + 1
+	// PunchErrUnreachable is a side with UDP blocked or no mapped address.
+	PunchErrUnreachable
+	// PunchErrIncompatible is a pair of NATs no strategy can open.
+	PunchErrIncompatible
+	PunchErrTimeout
+	// PunchErrAuth is a timeout with packets carrying wrong nonces only.
+	PunchErrAuth
+)
+
+var punchFailureDescription = map[PunchFailure]string{
+	PunchErrSignaling:    "signaling failed",
+	PunchErrUnreachable:  "a side is unreachable",
+	PunchErrIncompatible: "incompatible NATs",
+	PunchErrTimeout:      "no answer from the peer",
+	PunchErrAuth:         "the peer failed authentication",
+}
+
+func (f PunchFailure) String() string {
+	if s, ok := punchFailureDescription[f]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// PunchError details a failed hole punching.
+type PunchError struct {
+	Reason   PunchFailure
+	Strategy PunchStrategy
+	Local    NATType
+	Remote   NATType
+	// Targets are the addresses probed.
+	Targets []*net.UDPAddr
+	// Rejected counts the handshake packets with wrong nonces.
+	Rejected int
+	Err      error
+}
+
+func (e *PunchError) Error() string {
+	s := fmt.Sprintf("hole punching failed: %v (%v / %v, strategy %v, %d targets",
+		e.Reason, e.Local, e.Remote, e.Strategy, len(e.Targets))
+	if e.Rejected > 0 {
+		s += fmt.Sprintf(", %d rejected", e.Rejected)
+	}
+	s += ")"
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *PunchError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	defPunchTimeout      = 10 * time.Second
+	defPunchPredictRange = 8
+	punchMinInterval     = 20 * time.Millisecond
+	punchMaxInterval     = 500 * time.Millisecond
+)
+
+// PunchOptions configures Punch, zero values take the defaults.
+type PunchOptions struct {
+	// Candidate is the local side, see NewPunchCandidate.
+	Candidate *PunchCandidate
+	Signaling Signaling
+	// Timeout of the handshake after the signaling, 10s by default.
+	Timeout time.Duration
+	// PredictRange is the number of predicted ports probed, 8 by default.
+	PredictRange int
+}
+
+/*
+ * the handshake messages: "GSPN", a type, a token and an HMAC-SHA256 of
+ * them, truncated to 16 bytes. The first byte keeps them apart from STUN,
+ * DTLS and RTP in a Mux. The HMAC key of each direction is the nonce of the
+ * sender followed by the nonce of the receiver, both learned over the
+ * signaling only, so nobody else can forge a message, and messages of other
+ * punchings do not verify.
+ *
+ * Each side sends probes carrying a random token on a doubling schedule,
+ * and acknowledges every probe it gets with an ack echoing its token. A
+ * side is done once one of its probes was acknowledged and it acknowledged
+ * a probe of the peer: the path works both ways, and the peer got an ack
+ * unless that last one was lost. An on-path attacker can still relay the
+ * messages, the application protocol must authenticate the data itself.
+ */
+var punchMagic = []byte("GSPN")
+
+const (
+	punchProbe = 1
+	punchAck   = 2
+
+	punchTokenSize   = 16
+	punchMACSize     = 16
+	punchMessageSize = 4 + 1 + punchTokenSize + punchMACSize
+)
+
+// punchKey is the HMAC key of the messages from sender to receiver.
+func punchKey(sender, receiver []byte) []byte {
+	return append(append([]byte(nil), sender...), receiver...)
+}
+
+func punchMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)[:punchMACSize]
+}
+
+func punchMessage(types byte, token, key []byte) []byte {
+	msg := make([]byte, 0, punchMessageSize)
+	msg = append(msg, punchMagic...)
+	msg = append(msg, types)
+	msg = append(msg, token...)
+	return append(msg, punchMAC(key, msg)...)
+}
+
+// parsePunchMessage returns the type and the token of a handshake message,
+// and whether its HMAC verifies with key; zero for other packets.
+func parsePunchMessage(data, key []byte) (byte, []byte, bool) {
+	if len(data) != punchMessageSize || !bytes.Equal(data[:4], punchMagic) {
+		return 0, nil, false
+	}
+	types := data[4]
+	if types != punchProbe && types != punchAck {
+		return 0, nil, false
+	}
+	body := data[:punchMessageSize-punchMACSize]
+	ok := hmac.Equal(data[len(body):], punchMAC(key, body))
+	return types, data[5:len(body)], ok
+}
+
+// Punch opens a path to the peer from conn: the candidates are exchanged
+// over the signaling, then both sides probe each other until the HMAC
+// authenticated handshake completes both ways. conn must be the socket the
+// local candidate was discovered on, it must not be read by anyone else
+// during the handshake. Should the last ack to the peer be lost, the peer
+// completes once the PunchConn is read, which answers its probes. On
+// failure the error is a *PunchError.
+func Punch(ctx context.Context, conn net.PacketConn, opts PunchOptions) (*PunchConn, error) {
+	local := opts.Candidate
+	if local == nil || opts.Signaling == nil {
+		return nil, errors.New("hole punching needs a candidate and a signaling")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defPunchTimeout
+	}
+	if opts.PredictRange <= 0 {
+		opts.PredictRange = defPunchPredictRange
+	}
+
+	remote, err := opts.Signaling.Exchange(ctx, local)
+	if err != nil {
+		return nil, &PunchError{Reason: PunchErrSignaling, Local: local.NATType, Err: err}
+	}
+	perr := &PunchError{Local: local.NATType, Remote: remote.NATType}
+	var failure PunchFailure
+	perr.Strategy, failure = punchStrategy(local, remote)
+	if failure != 0 {
+		perr.Reason = failure
+		return nil, perr
+	}
+	perr.Targets = punchTargets(remote, perr.Strategy, opts.PredictRange)
+
+	deadline := time.Now().Add(opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	sendKey, recvKey := punchKey(local.Nonce, remote.Nonce), punchKey(remote.Nonce, local.Nonce)
+	token := make([]byte, punchTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	probe := punchMessage(punchProbe, token, sendKey)
+	// the peer address, once a probe was acknowledged
+	var peer *net.UDPAddr
+	acked := false
+	interval := punchMinInterval
+	var nextSend time.Time
+	buf := make([]byte, maxPacketSize)
+	for {
+		now := time.Now()
+		if ctx.Err() != nil || !now.Before(deadline) {
+			perr.Reason = PunchErrTimeout
+			if perr.Rejected > 0 {
+				perr.Reason = PunchErrAuth
+			}
+			perr.Err = ctx.Err()
+			return nil, perr
+		}
+		if peer == nil && !now.Before(nextSend) {
+			for _, target := range perr.Targets {
+				_, _ = conn.WriteTo(probe, target)
+			}
+			nextSend = now.Add(interval)
+			if interval *= 2; interval > punchMaxInterval {
+				interval = punchMaxInterval
+			}
+		}
+		wake := nextSend
+		if peer != nil {
+			// no more probes, wait for the ones of the peer
+			wake = now.Add(punchMaxInterval)
+		}
+		if deadline.Before(wake) {
+			wake = deadline
+		}
+		_ = conn.SetReadDeadline(wake)
+
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			perr.Reason = PunchErrTimeout
+			perr.Err = err
+			return nil, perr
+		}
+		types, msgToken, ok := parsePunchMessage(buf[:n], recvKey)
+		if types == 0 {
+			// not for the handshake, the application is not there yet
+			continue
+		}
+		if !ok || types == punchAck && !bytes.Equal(msgToken, token) {
+			perr.Rejected++
+			continue
+		}
+		from := toUDPAddr(addr)
+		if types == punchAck {
+			peer = from
+		} else {
+			_, _ = conn.WriteTo(punchMessage(punchAck, msgToken, sendKey), from)
+			acked = true
+		}
+		if peer != nil && acked {
+			return &PunchConn{PacketConn: conn, remote: peer, sendKey: sendKey, recvKey: recvKey}, nil
+		}
+		if peer != nil {
+			// our probes got through, the probes of the peer are coming
+			continue
+		}
+		// a symmetric peer shows its mapping toward us here, probe it
+		known := false
+		for _, target := range perr.Targets {
+			known = known || addrEqual(target, from)
+		}
+		if !known {
+			perr.Targets = append(perr.Targets, from)
+			nextSend = time.Time{}
+		}
+	}
+}
+
+// punchStrategy picks the strategy for a pair of NATs. A symmetric NAT
+// opens a new mapping toward the peer, which a port restricted or
+// symmetric peer only lets in when its port is predicted; other peers
+// learn it from the incoming probes.
+func punchStrategy(local, remote *PunchCandidate) (PunchStrategy, PunchFailure) {
+	for _, c := range []*PunchCandidate{local, remote} {
+		if c.MappedAddr == nil || c.NATType == NATTypeUdpBlocked || c.NATType == NATTypeError {
+			return PunchStrategyNone, PunchErrUnreachable
+		}
+	}
+	strict := func(nat NATType) bool {
+		return nat == NATTypePortRestricted || nat == NATTypeSymmetric
+	}
+	for _, pair := range [][2]*PunchCandidate{{local, remote}, {remote, local}} {
+		a, b := pair[0], pair[1]
+		if a.NATType == NATTypeSymmetric && a.NextPort == 0 && strict(b.NATType) {
+			return PunchStrategyNone, PunchErrIncompatible
+		}
+	}
+	if remote.NATType == NATTypeSymmetric {
+		return PunchStrategyPredict, 0
+	}
+	return PunchStrategyDirect, 0
+}
+
+// punchTargets lists the addresses to probe: the host addresses, the
+// mapped address, and for a symmetric peer its predicted ports.
+func punchTargets(remote *PunchCandidate, strategy PunchStrategy, predictRange int) []*net.UDPAddr {
+	var targets []*net.UDPAddr
+	add := func(addr *net.UDPAddr) {
+		for _, t := range targets {
+			if addrEqual(t, addr) {
+				return
+			}
+		}
+		targets = append(targets, addr)
+	}
+	for _, addr := range remote.HostAddrs {
+		add(addr)
+	}
+	add(remote.MappedAddr)
+	if strategy == PunchStrategyPredict && remote.NextPort != 0 {
+		for k := 0; k < predictRange; k++ {
+			add(&net.UDPAddr{IP: remote.MappedAddr.IP, Port: nextPort(remote.NextPort, k*remote.Delta)})
+		}
+	}
+	return targets
+}
+
+// PunchConn is the socket of a completed hole punching, connected to the
+// peer: packets from other sources are dropped, and late probes of the
+// peer are still acknowledged while reading.
+type PunchConn struct {
+	net.PacketConn
+	remote  *net.UDPAddr
+	sendKey []byte
+	recvKey []byte
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *PunchConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ReadFrom reads the next packet of the peer.
+func (c *PunchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if !addrEqual(toUDPAddr(addr), c.remote) {
+			continue
+		}
+		if types, token, ok := parsePunchMessage(b[:n], c.recvKey); types != 0 {
+			if types == punchProbe && ok {
+				_, _ = c.PacketConn.WriteTo(punchMessage(punchAck, token, c.sendKey), c.remote)
+			}
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// Read reads the next packet of the peer.
+func (c *PunchConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Write sends a packet to the peer.
+func (c *PunchConn) Write(b []byte) (int, error) {
+	return c.PacketConn.WriteTo(b, c.remote)
+}
@@ -0,0 +1,228 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSignaling is one end of an in-memory signaling channel.
+type testSignaling struct {
+	out chan<- *PunchCandidate
+	in  <-chan *PunchCandidate
+	// tamper, when set, changes the candidate received
+	tamper func(c *PunchCandidate)
+}
+
+func newTestSignaling() (*testSignaling, *testSignaling) {
+	ab := make(chan *PunchCandidate, 1)
+	ba := make(chan *PunchCandidate, 1)
+	return &testSignaling{out: ab, in: ba}, &testSignaling{out: ba, in: ab}
+}
+
+func (s *testSignaling) Exchange(ctx context.Context, local *PunchCandidate) (*PunchCandidate, error) {
+	s.out <- local
+	select {
+	case remote := <-s.in:
+		if s.tamper != nil {
+			copied := *remote
+			s.tamper(&copied)
+			remote = &copied
+		}
+		return remote, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func punchSide(t *testing.T) (net.PacketConn, *PunchCandidate) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	local := toUDPAddr(conn.LocalAddr())
+	cand, err := NewPunchCandidate(local, local, NATTypeOpenInternet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, cand
+}
+
+func TestPunch(t *testing.T) {
+	connA, candA := punchSide(t)
+	connB, candB := punchSide(t)
+	sigA, sigB := newTestSignaling()
+
+	type result struct {
+		conn *PunchConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := Punch(context.Background(), connB, PunchOptions{Candidate: candB, Signaling: sigB, Timeout: 2 * time.Second})
+		done <- result{c, err}
+	}()
+	a, err := Punch(context.Background(), connA, PunchOptions{Candidate: candA, Signaling: sigA, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := <-done
+	if rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	b := rb.conn
+	if !addrEqual(a.RemoteAddr().(*net.UDPAddr), toUDPAddr(connB.LocalAddr())) {
+		t.Errorf("A connected to %v", a.RemoteAddr())
+	}
+
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("B read %q, %v", buf[:n], err)
+	}
+}
+
+func TestPunchWrongNonce(t *testing.T) {
+	connA, candA := punchSide(t)
+	connB, candB := punchSide(t)
+	sigA, sigB := newTestSignaling()
+	// A expects another nonce than the one B uses
+	sigA.tamper = func(c *PunchCandidate) {
+		c.Nonce = make([]byte, punchNonceSize)
+	}
+
+	go Punch(context.Background(), connB, PunchOptions{Candidate: candB, Signaling: sigB, Timeout: 300 * time.Millisecond})
+	_, err := Punch(context.Background(), connA, PunchOptions{Candidate: candA, Signaling: sigA, Timeout: 300 * time.Millisecond})
+	var perr *PunchError
+	if !errors.As(err, &perr) || perr.Reason != PunchErrAuth || perr.Rejected == 0 {
+		t.Errorf("expect an authentication failure, got %v", err)
+	}
+}
+
+// countingConn counts the reads of a PacketConn.
+type countingConn struct {
+	net.PacketConn
+	reads int32
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.PacketConn.ReadFrom(b)
+}
+
+func TestPunchWaitsForPeerProbe(t *testing.T) {
+	connA, candA := punchSide(t)
+	connB, candB := punchSide(t)
+	sigA, sigB := newTestSignaling()
+	counted := &countingConn{PacketConn: connA}
+
+	/*
+	 * B acknowledges the first probe of A at once, and sends its own probe
+	 * only later: A waits for it without spinning
+	 */
+	go func() {
+		candA, err := sigB.Exchange(context.Background(), candB)
+		if err != nil {
+			return
+		}
+		keyAB, keyBA := punchKey(candA.Nonce, candB.Nonce), punchKey(candB.Nonce, candA.Nonce)
+		buf := make([]byte, maxPacketSize)
+		_ = connB.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := connB.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		types, token, ok := parsePunchMessage(buf[:n], keyAB)
+		if types != punchProbe || !ok {
+			return
+		}
+		_, _ = connB.WriteTo(punchMessage(punchAck, token, keyBA), from)
+		time.Sleep(300 * time.Millisecond)
+		_, _ = connB.WriteTo(punchMessage(punchProbe, make([]byte, punchTokenSize), keyBA), from)
+	}()
+	if _, err := Punch(context.Background(), counted, PunchOptions{Candidate: candA, Signaling: sigA, Timeout: 2 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if reads := atomic.LoadInt32(&counted.reads); reads > 10 {
+		t.Errorf("%d reads while waiting for the probe of the peer", reads)
+	}
+}
+
+func TestPunchMessage(t *testing.T) {
+	nonceA, nonceB := make([]byte, punchNonceSize), make([]byte, punchNonceSize)
+	nonceA[0], nonceB[0] = 1, 2
+	token := make([]byte, punchTokenSize)
+	token[0] = 3
+	msg := punchMessage(punchProbe, token, punchKey(nonceA, nonceB))
+	if bytes.Contains(msg, nonceA) || bytes.Contains(msg, nonceB) {
+		t.Error("the nonces are on the wire")
+	}
+	types, got, ok := parsePunchMessage(msg, punchKey(nonceA, nonceB))
+	if types != punchProbe || !ok || !bytes.Equal(got, token) {
+		t.Errorf("parsed %v %x %v", types, got, ok)
+	}
+
+	/*
+	 * an ack made of a captured probe, the message of the other direction
+	 * and a message of another key do not verify
+	 */
+	forged := append([]byte(nil), msg...)
+	forged[4] = punchAck
+	if _, _, ok := parsePunchMessage(forged, punchKey(nonceA, nonceB)); ok {
+		t.Error("accepted a probe turned into an ack")
+	}
+	if _, _, ok := parsePunchMessage(msg, punchKey(nonceB, nonceA)); ok {
+		t.Error("accepted a message of the other direction")
+	}
+	if _, _, ok := parsePunchMessage(msg, punchKey(nonceA, make([]byte, punchNonceSize))); ok {
+		t.Error("accepted a message of another key")
+	}
+	if types, _, _ := parsePunchMessage([]byte("hello"), punchKey(nonceA, nonceB)); types != 0 {
+		t.Error("took another packet for the handshake")
+	}
+}
+
+func TestPunchStrategy(t *testing.T) {
+	mapped := &net.UDPAddr{IP: testNATIP, Port: 40000}
+	cand := func(nat NATType, next int) *PunchCandidate {
+		return &PunchCandidate{MappedAddr: mapped, NATType: nat, NextPort: next, Delta: 2}
+	}
+	cases := []struct {
+		local, remote *PunchCandidate
+		strategy      PunchStrategy
+		failure       PunchFailure
+	}{
+		{cand(NATTypeFullCone, 0), cand(NATTypePortRestricted, 0), PunchStrategyDirect, 0},
+		{cand(NATTypeSymmetric, 0), cand(NATTypeRestricted, 0), PunchStrategyDirect, 0},
+		{cand(NATTypeSymmetric, 0), cand(NATTypePortRestricted, 0), PunchStrategyNone, PunchErrIncompatible},
+		{cand(NATTypePortRestricted, 0), cand(NATTypeSymmetric, 40010), PunchStrategyPredict, 0},
+		{cand(NATTypeSymmetric, 0), cand(NATTypeSymmetric, 0), PunchStrategyNone, PunchErrIncompatible},
+		{cand(NATTypeUdpBlocked, 0), cand(NATTypeFullCone, 0), PunchStrategyNone, PunchErrUnreachable},
+	}
+	for i, tc := range cases {
+		strategy, failure := punchStrategy(tc.local, tc.remote)
+		if strategy != tc.strategy || failure != tc.failure {
+			t.Errorf("case %d: %v %v, expect %v %v", i, strategy, failure, tc.strategy, tc.failure)
+		}
+	}
+
+	targets := punchTargets(cand(NATTypeSymmetric, 40010), PunchStrategyPredict, 3)
+	want := []int{40000, 40010, 40012, 40014}
+	if len(targets) != len(want) {
+		t.Fatalf("targets %v", targets)
+	}
+	for i, port := range want {
+		if targets[i].Port != port {
+			t.Errorf("target %d %v, expect port %d", i, targets[i], port)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// testServer is a minimal STUN server on the loopback, answering Binding
+// requests over UDP and TCP.
+type testServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+
+	mu       sync.Mutex
+	accepted int
+	// handler builds the response to a request, nil drops the request.
+	handler func(req *packet, from *net.UDPAddr) *packet
+}
+
+func newTestServer(t *testing.T) *testServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		udp.Close()
+		t.Skip("can not listen on loopback:", err)
+	}
+	s := &testServer{udp: udp, tcp: tcp, handler: bindingResponse}
+	go s.serveUDP()
+	go s.serveStream(tcp)
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return s
+}
+
+func (s *testServer) setHandler(handler func(req *packet, from *net.UDPAddr) *packet) {
+	s.mu.Lock()
+	s.handler = handler
+	s.mu.Unlock()
+}
+
+func (s *testServer) udpAddr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testServer) tcpAddr() string {
+	return s.tcp.Addr().String()
+}
+
+func (s *testServer) respond(data []byte, from *net.UDPAddr) []byte {
+	req, err := parsePackage(data)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	handler := s.handler
+	s.mu.Unlock()
+	resp := handler(req, from)
+	if resp == nil {
+		return nil
+	}
+	return resp.serialize()
+}
+
+func (s *testServer) serveUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.respond(buf[:n], from.(*net.UDPAddr)); resp != nil {
+			_, _ = s.udp.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *testServer) serveStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.mu.Unlock()
+		go func(conn net.Conn) {
+			defer conn.Close()
+			from := toUDPAddr(conn.RemoteAddr())
+			for {
+				data, err := readMessage(conn)
+				if err != nil {
+					return
+				}
+				if resp := s.respond(data, from); resp != nil {
+					_, _ = conn.Write(resp)
+				}
+			}
+		}(conn)
+	}
+}
+
+// bindingResponse answers a Binding request with the source address of the
+// request as MAPPED-ADDRESS.
+func bindingResponse(req *packet, from *net.UDPAddr) *packet {
+	if req.types != msgTypeBindingRequest {
+		return nil
+	}
+	resp, _ := newPacket()
+	resp.types = msgTypeBindingResponse
+	resp.transID = req.transID
+	resp.addAttribute(*newAddrAttribute(attributeMappedAddress, from))
+	return resp
+}
@@ -0,0 +1,181 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServerStats is the configuration and the reachability record of one
+// server of a ServerList.
+type ServerStats struct {
+	Addr   string
+	Weight int
+
+	Attempts int
+	Failures int
+	// RTT is the smoothed round trip time of test I, from the send it
+	// answered, zero until the server answered once.
+	RTT time.Duration
+	// LastOK tells the last attempt got an answer.
+	LastOK bool
+}
+
+// Reachability is the share of the attempts the server answered, 1 for a
+// server never tried.
+func (s *ServerStats) Reachability() float64 {
+	if s.Attempts == 0 {
+		return 1
+	}
+	return float64(s.Attempts-s.Failures) / float64(s.Attempts)
+}
+
+// ServerList is an ordered list of STUN servers with weights, ranked by the
+// outcome of past attempts. It is safe for concurrent use.
+type ServerList struct {
+	mu      sync.Mutex
+	servers []*ServerStats
+}
+
+// NewServerList creates a list of servers in order of preference, all of
+// weight 1.
+func NewServerList(addrs ...string) *ServerList {
+	l := &ServerList{}
+	for _, addr := range addrs {
+		l.Add(addr, 1)
+	}
+	return l
+}
+
+// Add appends a server to the list. Among servers which are equally
+// reachable and not yet measured, a higher weight ranks first; once
+// measured, the RTT is divided by the weight.
+func (l *ServerList) Add(addr string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	l.mu.Lock()
+	l.servers = append(l.servers, &ServerStats{Addr: addr, Weight: weight})
+	l.mu.Unlock()
+}
+
+// Stats returns a copy of the records, in configuration order.
+func (l *ServerList) Stats() []ServerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]ServerStats, len(l.servers))
+	for i, s := range l.servers {
+		stats[i] = *s
+	}
+	return stats
+}
+
+// Ranked returns the servers in the order they should be tried: the ones
+// whose last attempt failed go last, then the less reachable ones, then
+// the ones with the longer weighted RTT. Unmeasured servers follow the
+// measured ones, by weight and configuration order.
+func (l *ServerList) Ranked() []string {
+	l.mu.Lock()
+	servers := make([]*ServerStats, len(l.servers))
+	copy(servers, l.servers)
+	l.mu.Unlock()
+
+	failedLast := func(s *ServerStats) bool {
+		return s.Attempts > 0 && !s.LastOK
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if failedLast(a) != failedLast(b) {
+			return !failedLast(a)
+		}
+		if ra, rb := a.Reachability(), b.Reachability(); ra != rb {
+			return ra > rb
+		}
+		if (a.RTT > 0) != (b.RTT > 0) {
+			return a.RTT > 0
+		}
+		if a.RTT > 0 {
+			return a.RTT/time.Duration(a.Weight) < b.RTT/time.Duration(b.Weight)
+		}
+		return a.Weight > b.Weight
+	})
+
+	addrs := make([]string, len(servers))
+	for i, s := range servers {
+		addrs[i] = s.Addr
+	}
+	return addrs
+}
+
+// record adds the outcome of an attempt, the RTT is smoothed like the SRTT
+// of TCP.
+func (l *ServerList) record(addr string, ok bool, rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.servers {
+		if s.Addr != addr {
+			continue
+		}
+		s.Attempts++
+		s.LastOK = ok
+		if !ok {
+			s.Failures++
+			return
+		}
+		if s.RTT == 0 {
+			s.RTT = rtt
+		} else {
+			s.RTT = (7*s.RTT + rtt) / 8
+		}
+		return
+	}
+}
+
+// DiscoveryList runs a discovery against the servers of the list in rank
+// order. A server which does not answer test I, or fails to resolve, is
+// recorded as failed and the next one is tried; the first answering server
+// completes the discovery. Server returns the one used.
+func (c *Client) DiscoveryList(list *ServerList) (NATType, error) {
+	servers := list.Ranked()
+	if len(servers) == 0 {
+		return NATTypeError, errors.New("no STUN server")
+	}
+
+	nattyp, err := NATTypeError, error(nil)
+	for _, server := range servers {
+		c.evidence = nil
+		c.test1RTT = 0
+		nattyp, err = c.Discovery(server)
+		answered := c.evidence != nil && c.evidence.Test1 == TestPassed
+		if c.transportFor(server) != TransportUDP {
+			answered = err == nil
+		}
+		list.record(server, answered, c.test1RTT)
+		if answered {
+			return nattyp, err
+		}
+	}
+	// every server failed, a UDP blocked answer from all of them stands
+	return nattyp, err
+}
+
+// Server returns the server of the last discovery, as it was given.
+func (c *Client) Server() string {
+	return c.srvName
+}
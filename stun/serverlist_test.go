@@ -0,0 +1,88 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerListRanked(t *testing.T) {
+	l := NewServerList("a", "b", "c")
+	l.Add("d", 5)
+	if got := l.Ranked(); got[0] != "d" || got[1] != "a" {
+		t.Errorf("unmeasured servers ranked %v, expect the heavier d then the configured order", got)
+	}
+
+	l.record("a", false, 0)
+	l.record("b", true, 80*time.Millisecond)
+	l.record("c", true, 20*time.Millisecond)
+	got := l.Ranked()
+	want := []string{"c", "b", "d", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ranked %v, expect %v", got, want)
+		}
+	}
+
+	l.record("a", true, 10*time.Millisecond)
+	l.record("c", true, 20*time.Millisecond)
+	if got := l.Ranked(); got[len(got)-1] != "a" {
+		t.Errorf("the less reachable server a ranked %v", got)
+	}
+}
+
+func TestDiscoveryListFailover(t *testing.T) {
+	srv := newTestServer5780(t, &testNAT{})
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	l := NewServerList(deadAddr, srv.addr(0, 0).String())
+	client := NewClient()
+	client.rto = 10 * time.Millisecond
+	client.maxSends = 4
+	nat, err := client.DiscoveryList(l)
+	if err != nil {
+		t.Fatalf("discovery error: %v", err)
+	}
+	if nat != NATTypeFullCone || client.Server() != srv.addr(0, 0).String() {
+		t.Errorf("discovery got %v from %s", nat, client.Server())
+	}
+
+	stats := l.Stats()
+	if stats[0].Failures != 1 || stats[1].Failures != 0 || stats[1].RTT <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if got := l.Ranked(); got[0] != srv.addr(0, 0).String() {
+		t.Errorf("the answering server is not ranked first: %v", got)
+	}
+}
+
+func TestDiscoveryListRTTAfterLoss(t *testing.T) {
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	// the first send of every transaction is lost
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[string(req.transID)] {
+			seen[string(req.transID)] = true
+			return nil
+		}
+		return natResponse(0)(req, from)
+	})
+
+	l := NewServerList(srv.udpAddr())
+	client := NewClient()
+	client.rto = 200 * time.Millisecond
+	client.maxSends = 3
+	_, _ = client.DiscoveryList(l)
+	if rtt := l.Stats()[0].RTT; rtt <= 0 || rtt >= 100*time.Millisecond {
+		t.Errorf("RTT %v counts the retransmission wait", rtt)
+	}
+}
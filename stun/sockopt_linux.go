@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, ifName string) error {
+	return syscall.BindToDevice(int(fd), ifName)
+}
+
+// setDontFragment sets or clears DF on the datagrams of the socket. This
+// turns off the path MTU discovery of the kernel: with DF the sends larger
+// than the known path MTU fail with EMSGSIZE, without it they are
+// fragmented.
+func setDontFragment(fd uintptr, ipv6 bool, df bool) error {
+	if ipv6 {
+		v := syscall.IPV6_PMTUDISC_DONT
+		if df {
+			v = syscall.IPV6_PMTUDISC_DO
+		}
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v)
+	}
+	v := syscall.IP_PMTUDISC_DONT
+	if df {
+		v = syscall.IP_PMTUDISC_DO
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v)
+}
+
+// setReusePort lets the TCP sockets of a test share their local port, the
+// listening one included.
+func setReusePort(fd uintptr) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
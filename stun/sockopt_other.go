@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+// bindToDevice is a no-op outside Linux, the socket is only bound to the
+// interface address.
+func bindToDevice(fd uintptr, ifName string) error {
+	return nil
+}
+
+// setDontFragment can not set DF outside Linux, the datagrams keep the
+// default of the system.
+func setDontFragment(fd uintptr, ipv6 bool, df bool) error {
+	if df {
+		return errDontFragment
+	}
+	return nil
+}
+
+// setReusePort is not supported outside Linux, the TCP tests needing
+// several sockets on one port fail.
+func setReusePort(fd uintptr) error {
+	return errReusePort
+}
@@ -0,0 +1,231 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver is the DNS lookup used by LookupServers, *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ServerRecord is a STUN server published in the DNS.
+type ServerRecord struct {
+	Transport Transport
+	// Host is the name of the server, the one TLS checks the certificate
+	// against.
+	Host string
+	Port int
+	// IP is the address Host resolved to when the domain has no SRV
+	// record, nil otherwise.
+	IP net.IP
+}
+
+// Addr returns the host:port of the server.
+func (r ServerRecord) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// DialAddr returns the address to run a Client against: the ip:port of the
+// server when it was resolved, except over TLS, where the host:port is kept
+// for the certificate checks.
+func (r ServerRecord) DialAddr() string {
+	if r.IP == nil || r.Transport == TransportTLS {
+		return r.Addr()
+	}
+	return net.JoinHostPort(r.IP.String(), strconv.Itoa(r.Port))
+}
+
+// URI returns the server as a stun: or stuns: URI.
+func (r ServerRecord) URI() *URI {
+	scheme := SchemeSTUN
+	if r.Transport == TransportTLS {
+		scheme = SchemeSTUNS
+	}
+	return &URI{Scheme: scheme, Host: r.Host, Port: r.Port}
+}
+
+func (r ServerRecord) String() string {
+	s := r.Transport.String() + " " + r.Addr()
+	if r.IP != nil {
+		s += " (" + r.IP.String() + ")"
+	}
+	return s
+}
+
+// the SRV services of RFC 5389 9 and RFC 7064, in the order they are
+// looked up
+var srvServices = []struct {
+	service   string
+	proto     string
+	transport Transport
+	port      int
+}{
+	{"stun", "udp", TransportUDP, DefaultPort},
+	{"stun", "tcp", TransportTCP, DefaultPort},
+	{"stuns", "tcp", TransportTLS, DefaultTLSPort},
+}
+
+/*
+ * RFC 5389 9: the client looks up the SRV records of _stun._udp, _stun._tcp
+ * and _stuns._tcp under the domain, and uses them in the order of RFC 2782.
+ * If no SRV record is found at all, it uses the A and AAAA records of the
+ * domain with the default port of each transport. The records keep the
+ * domain as host, for the name checks of TLS.
+ */
+
+// LookupServers discovers the STUN servers of domain, grouped by transport
+// (UDP, TCP, TLS) and in the order they should be tried. A nil resolver is
+// net.DefaultResolver.
+func LookupServers(ctx context.Context, domain string, r Resolver) ([]ServerRecord, error) {
+	return lookupServers(ctx, domain, r, rand.Intn)
+}
+
+func lookupServers(ctx context.Context, domain string, r Resolver, rnd func(n int) int) ([]ServerRecord, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	domain = strings.TrimSuffix(domain, ".")
+
+	var records []ServerRecord
+	for _, svc := range srvServices {
+		_, srvs, err := r.LookupSRV(ctx, svc.service, svc.proto, domain)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// no record of this service
+			continue
+		}
+		for _, srv := range orderSRV(srvs, rnd) {
+			records = append(records, ServerRecord{
+				Transport: svc.transport,
+				Host:      strings.TrimSuffix(srv.Target, "."),
+				Port:      int(srv.Port),
+			})
+		}
+	}
+	if len(records) > 0 {
+		return records, nil
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range srvServices {
+		for _, addr := range addrs {
+			records = append(records, ServerRecord{
+				Transport: svc.transport,
+				Host:      domain,
+				Port:      svc.port,
+				IP:        addr.IP,
+			})
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no STUN server found for " + domain)
+	}
+	return records, nil
+}
+
+// orderSRV orders the records as RFC 2782 asks: by ascending priority, and
+// within one priority by a weighted random selection, where records of
+// weight 0 have a very small chance to be picked first. A target of "."
+// means the service is not available.
+func orderSRV(srvs []*net.SRV, rnd func(n int) int) []*net.SRV {
+	byPriority := make([]*net.SRV, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv.Target != "." && srv.Target != "" {
+			byPriority = append(byPriority, srv)
+		}
+	}
+	sort.SliceStable(byPriority, func(i, j int) bool {
+		return byPriority[i].Priority < byPriority[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(byPriority))
+	for i := 0; i < len(byPriority); {
+		j := i
+		for j < len(byPriority) && byPriority[j].Priority == byPriority[i].Priority {
+			j++
+		}
+		ordered = append(ordered, selectByWeight(byPriority[i:j], rnd)...)
+		i = j
+	}
+	return ordered
+}
+
+// selectByWeight orders records of the same priority: the ones of weight 0
+// are placed first, then repeatedly a random number between 0 and the sum
+// of the remaining weights picks the first record whose running sum reaches
+// it.
+func selectByWeight(srvs []*net.SRV, rnd func(n int) int) []*net.SRV {
+	pending := make([]*net.SRV, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv.Weight == 0 {
+			pending = append(pending, srv)
+		}
+	}
+	for _, srv := range srvs {
+		if srv.Weight != 0 {
+			pending = append(pending, srv)
+		}
+	}
+
+	ordered := make([]*net.SRV, 0, len(srvs))
+	for len(pending) > 0 {
+		sum := 0
+		for _, srv := range pending {
+			sum += int(srv.Weight)
+		}
+		pick := rnd(sum + 1)
+		running := 0
+		for k, srv := range pending {
+			running += int(srv.Weight)
+			if running >= pick {
+				ordered = append(ordered, srv)
+				pending = append(pending[:k], pending[k+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// NewServerListFromRecords builds a ServerList of the records of one
+// transport, in the order LookupServers gave them, by DialAddr.
+func NewServerListFromRecords(records []ServerRecord, t Transport) *ServerList {
+	l := &ServerList{}
+	added := make(map[string]bool)
+	for _, r := range records {
+		if r.Transport == t && !added[r.DialAddr()] {
+			added[r.DialAddr()] = true
+			l.Add(r.DialAddr(), 1)
+		}
+	}
+	return l
+}
@@ -0,0 +1,227 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+/*
+ * a stand-in DNS server answering SRV, A and AAAA queries from fixed records,
+ * and with no answer for everything else
+ */
+type testDNS struct {
+	conn net.PacketConn
+	srv  map[string][]*net.SRV
+	a    map[string]net.IP
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSRV  = 33
+	dnsTypeAAAA = 28
+)
+
+// newTestDNS serves the records, which must not change afterwards.
+func newTestDNS(t *testing.T, srv map[string][]*net.SRV, a map[string]net.IP) *testDNS {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	d := &testDNS{conn: conn, srv: srv, a: a}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *testDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", d.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (d *testDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := d.answer(buf[:n]); reply != nil {
+			d.conn.WriteTo(reply, from)
+		}
+	}
+}
+
+func (d *testDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// the question: labels, then type and class
+	i := 12
+	var labels []string
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	i++
+	if i+4 > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(query[i:])
+	question := query[12 : i+4]
+
+	var answers [][]byte
+	switch qtype {
+	case dnsTypeSRV:
+		for _, srv := range d.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], srv.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], srv.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], srv.Port)
+			answers = append(answers, dnsRecord(qtype, append(rdata, dnsName(srv.Target)...)))
+		}
+	case dnsTypeA:
+		if ip := d.a[name]; ip.To4() != nil {
+			answers = append(answers, dnsRecord(qtype, ip.To4()))
+		}
+	case dnsTypeAAAA:
+		if ip := d.a[name]; ip != nil && ip.To4() == nil {
+			answers = append(answers, dnsRecord(qtype, ip.To16()))
+		}
+	}
+
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+	binary.BigEndian.PutUint16(reply[2:], 0x8180)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	reply = append(reply, question...)
+	for _, a := range answers {
+		reply = append(reply, a...)
+	}
+	return reply
+}
+
+// dnsRecord is an answer for the name of the question, of class IN.
+func dnsRecord(qtype uint16, rdata []byte) []byte {
+	rr := make([]byte, 12)
+	binary.BigEndian.PutUint16(rr[0:], 0xc00c)
+	binary.BigEndian.PutUint16(rr[2:], qtype)
+	binary.BigEndian.PutUint16(rr[4:], 1)
+	binary.BigEndian.PutUint32(rr[6:], 60)
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func TestLookupServersSRV(t *testing.T) {
+	d := newTestDNS(t, map[string][]*net.SRV{
+		"_stun._udp.example.test": {
+			{Target: "backup.example.test.", Port: 3479, Priority: 20, Weight: 0},
+			{Target: "stun1.example.test.", Port: 3478, Priority: 10, Weight: 10},
+		},
+		"_stuns._tcp.example.test": {
+			{Target: "tls.example.test.", Port: 5349, Priority: 10, Weight: 0},
+		},
+	}, nil)
+
+	records, err := LookupServers(context.Background(), "example.test", d.resolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"udp stun1.example.test:3478", "udp backup.example.test:3479", "tls tls.example.test:5349"}
+	if len(records) != len(expect) {
+		t.Fatalf("records %v, expect %v", records, expect)
+	}
+	for i, r := range records {
+		if r.String() != expect[i] {
+			t.Errorf("record %d %v, expect %s", i, r, expect[i])
+		}
+	}
+	if u := records[2].URI().String(); u != "stuns:tls.example.test:5349" {
+		t.Errorf("URI %s, expect stuns:tls.example.test:5349", u)
+	}
+}
+
+func TestLookupServersFallback(t *testing.T) {
+	d := newTestDNS(t, nil, map[string]net.IP{"plain.example.test": net.IPv4(192, 0, 2, 1)})
+
+	records, err := LookupServers(context.Background(), "plain.example.test", d.resolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"udp plain.example.test:3478 (192.0.2.1)", "tcp plain.example.test:3478 (192.0.2.1)",
+		"tls plain.example.test:5349 (192.0.2.1)"}
+	if len(records) != len(expect) {
+		t.Fatalf("records %v, expect %v", records, expect)
+	}
+	for i, r := range records {
+		if r.String() != expect[i] {
+			t.Errorf("record %d %v, expect %s", i, r, expect[i])
+		}
+	}
+	// the TLS server is checked against the domain, not its address
+	if u := records[2].URI().String(); u != "stuns:plain.example.test:5349" {
+		t.Errorf("URI %s, expect stuns:plain.example.test:5349", u)
+	}
+	if a := records[0].DialAddr(); a != "192.0.2.1:3478" {
+		t.Errorf("dial address %s, expect 192.0.2.1:3478", a)
+	}
+	if a := records[2].DialAddr(); a != "plain.example.test:5349" {
+		t.Errorf("TLS dial address %s, expect plain.example.test:5349", a)
+	}
+}
+
+func TestLookupServersCanceled(t *testing.T) {
+	d := newTestDNS(t, nil, map[string]net.IP{"plain.example.test": net.IPv4(192, 0, 2, 1)})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if records, err := LookupServers(ctx, "plain.example.test", d.resolver()); err != context.Canceled {
+		t.Errorf("records %v, error %v, expect %v", records, err, context.Canceled)
+	}
+}
+
+func TestOrderSRVWeight(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "a.", Priority: 1, Weight: 10},
+		{Target: "b.", Priority: 1, Weight: 30},
+		{Target: "zero.", Priority: 1, Weight: 0},
+		{Target: ".", Priority: 0, Weight: 100},
+	}
+	// the random pick 25 passes zero (0) and a (10), and lands on b (40)
+	picks := []int{25, 0, 0}
+	rnd := func(n int) int {
+		p := picks[0]
+		picks = picks[1:]
+		if p >= n {
+			t.Fatalf("pick %d out of [0, %d)", p, n)
+		}
+		return p
+	}
+	var order []string
+	for _, srv := range orderSRV(srvs, rnd) {
+		order = append(order, srv.Target)
+	}
+	if got := strings.Join(order, " "); got != "b. zero. a." {
+		t.Errorf("order %s, expect b. zero. a.", got)
+	}
+}
@@ -0,0 +1,451 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errReusePort = errors.New("sharing a TCP port between sockets is only supported on Linux")
+
+// the wait for a connect-back of the server, which answers on the original
+// connection when it can not connect
+const tcpConnectBackTimeoutMs = 5000
+
+// the wait for the simultaneous open, long enough for a retransmitted SYN
+const tcpSimultaneousOpenTimeoutMs = 3000
+
+// TCPBehavior is the RFC 5780 classification applied to TCP. NATs often
+// treat TCP differently from UDP, it is reported apart from NATBehavior.
+type TCPBehavior struct {
+	Mapping MappingBehavior
+	// Filtering is tested with inbound SYNs from the server, unknown when
+	// the server does not connect back, which standard servers do not.
+	Filtering FilteringBehavior
+	// SimultaneousOpen tells the NAT let in a SYN crossing an outbound one
+	// and the connection opened without a listener. It is tested through
+	// the hairpinning of the NAT, false without one for TCP, and false when
+	// no NAT is on the path.
+	SimultaneousOpen bool
+
+	LocalAddr  *net.UDPAddr
+	MappedAddr *net.UDPAddr
+	OtherAddr  *net.UDPAddr
+}
+
+func (b *TCPBehavior) String() string {
+	filtering := b.Filtering.String()
+	if b.Filtering == FilteringUnknown {
+		filtering += ", the server does not connect back on CHANGE-REQUEST, a non-standard extension"
+	}
+	return fmt.Sprintf("TCP mapping: %v\nTCP filtering: %v\nTCP simultaneous open: %v\nLocal address: %v\nMapped address: %v\nOther address: %v",
+		b.Mapping, filtering, b.SimultaneousOpen, b.LocalAddr, b.MappedAddr, b.OtherAddr)
+}
+
+/*
+ * The mapping test is RFC 5780 4.3 over TCP: connections from one local
+ * port to the primary address, to the alternate IP and primary port, and to
+ * the alternate address, compare their mapped addresses.
+ *
+ * CHANGE-REQUEST can not move a response to another connection, so the
+ * filtering test needs a server which connects back, an extension of no
+ * standard: on a Binding request with CHANGE-REQUEST over TCP, it connects
+ * from the requested address to the source of the connection and answers
+ * over the new connection, or over the original one when it could not
+ * connect. A standard server rejects CHANGE-REQUEST over TCP or ignores it,
+ * which leaves the filtering unknown. The inbound SYN from the alternate
+ * address (Test II), then from the primary IP and alternate port (Test
+ * III), tell the filtering as RFC 5780 4.4 does.
+ *
+ * The simultaneous open test connects, from a port without listener, to
+ * its own mapped address. A NAT hairpinning the SYN back from the mapped
+ * address hands it to the connecting socket, whose SYN it crosses: the
+ * kernel completes the connection by simultaneous open, or refuses it. It
+ * needs an endpoint independent mapping, for the hairpinned SYN to come
+ * from the address dialed.
+ *
+ * Every test shares one local port between several sockets, which takes
+ * SO_REUSEPORT, so this runs on Linux only.
+ */
+
+// DiscoverTCPBehavior runs the mapping, filtering and simultaneous open
+// tests over TCP, against a server supporting OTHER-ADDRESS. The filtering
+// test needs a server connecting back on CHANGE-REQUEST, an extension of
+// no standard: against other servers the filtering is unknown.
+func (c *Client) DiscoverTCPBehavior(srvAddrStr string) (*TCPBehavior, error) {
+	if c.transport == TransportTLS {
+		return nil, errors.New("TCP behavior discovery runs over plain TCP")
+	}
+	transport := c.transportOpt
+	c.transport, c.transportOpt = TransportTCP, TransportTCP
+	defer func() {
+		c.transport, c.transportOpt = transport, transport
+	}()
+	if err := c.prepare(srvAddrStr); err != nil {
+		return nil, err
+	}
+	if c.transport != TransportTCP {
+		return nil, errors.New("TCP behavior discovery runs over plain TCP")
+	}
+	local, err := c.selectLocalAddr(c.nSrvAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &TCPBehavior{}
+	if err := c.doTCPMappingTest(b, local.IP); err != nil {
+		return b, err
+	}
+	if err := c.doTCPFilteringTest(b, local.IP); err != nil {
+		return b, err
+	}
+	if err := c.doTCPSimultaneousOpenTest(b, local.IP); err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+func (c *Client) doTCPMappingTest(b *TCPBehavior, ip net.IP) error {
+	ep, err := c.newTCPEndpoint(ip)
+	if err != nil {
+		return err
+	}
+	defer ep.close()
+
+	reply, _, err := ep.binding(c.nSrvAddr, buildBindingRequestRFC5389(false, false))
+	if err != nil {
+		return err
+	}
+	b.LocalAddr = ep.addr
+	b.MappedAddr = reply.getReflexiveAddr()
+	b.OtherAddr = reply.getOtherAddr()
+	c.nLocalAddr, c.nMappedAddr, c.nChangedAddr = b.LocalAddr, b.MappedAddr, b.OtherAddr
+	if b.MappedAddr == nil {
+		return errors.New("the STUN server sent no mapped address")
+	}
+	if b.OtherAddr == nil {
+		return errors.New("the STUN server does not support RFC 5780, no OTHER-ADDRESS")
+	}
+	if addrEqual(b.MappedAddr, b.LocalAddr) {
+		b.Mapping = MappingEndpointIndependent
+		return nil
+	}
+
+	reply2, _, err := ep.binding(&net.UDPAddr{IP: b.OtherAddr.IP, Port: c.nSrvAddr.Port}, buildBindingRequestRFC5389(false, false))
+	if err != nil {
+		return err
+	}
+	if addrEqual(reply2.getReflexiveAddr(), b.MappedAddr) {
+		b.Mapping = MappingEndpointIndependent
+		return nil
+	}
+	reply3, _, err := ep.binding(b.OtherAddr, buildBindingRequestRFC5389(false, false))
+	if err != nil {
+		return err
+	}
+	if addrEqual(reply3.getReflexiveAddr(), reply2.getReflexiveAddr()) {
+		b.Mapping = MappingAddressDependent
+	} else {
+		b.Mapping = MappingAddressAndPortDependent
+	}
+	return nil
+}
+
+func (c *Client) doTCPFilteringTest(b *TCPBehavior, ip net.IP) error {
+	ep, err := c.newTCPEndpoint(ip)
+	if err != nil {
+		return err
+	}
+	defer ep.close()
+	// the connection opening the mapping the server connects back to
+	_, primary, err := ep.binding(c.nSrvAddr, buildBindingRequestRFC5389(false, false))
+	if err != nil {
+		return err
+	}
+
+	passed, err := ep.connectBack(primary, true, true)
+	if errors.Is(err, errConnectBackUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if passed {
+		b.Filtering = FilteringEndpointIndependent
+		return nil
+	}
+	passed, err = ep.connectBack(primary, false, true)
+	if errors.Is(err, errConnectBackUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if passed {
+		b.Filtering = FilteringAddressDependent
+	} else {
+		b.Filtering = FilteringAddressAndPortDependent
+	}
+	return nil
+}
+
+func (c *Client) doTCPSimultaneousOpenTest(b *TCPBehavior, ip net.IP) error {
+	if b.Mapping != MappingEndpointIndependent {
+		// the hairpinned SYN would not come from the address dialed
+		return nil
+	}
+	ep, err := c.newTCPEndpoint(ip)
+	if err != nil {
+		return err
+	}
+	defer ep.close()
+	// no listener may take the SYN
+	ep.listener.Close()
+	reply, _, err := ep.binding(c.nSrvAddr, buildBindingRequestRFC5389(false, false))
+	if err != nil {
+		return err
+	}
+	mapped := reply.getReflexiveAddr()
+	if mapped == nil {
+		return errors.New("the STUN server sent no mapped address")
+	}
+	if addrEqual(mapped, ep.addr) {
+		// no NAT, the dial would connect the socket to itself
+		return nil
+	}
+
+	dialer := ep.dialer
+	dialer.Timeout = tcpSimultaneousOpenTimeoutMs * time.Millisecond
+	conn, err := dialer.Dial("tcp", mapped.String())
+	if err != nil {
+		// refused or lost, no simultaneous open
+		return nil
+	}
+	ep.keep(conn)
+	// the connection is to itself: what is sent comes back
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	if _, err := conn.Write(token); err != nil {
+		return nil
+	}
+	got := make([]byte, len(token))
+	_ = conn.SetReadDeadline(time.Now().Add(tcpSimultaneousOpenTimeoutMs * time.Millisecond))
+	if _, err := io.ReadFull(conn, got); err == nil && bytes.Equal(got, token) {
+		b.SimultaneousOpen = true
+	}
+	return nil
+}
+
+var errConnectBackUnsupported = errors.New("the STUN server does not connect back over TCP")
+
+// tcpEndpoint is a local TCP port shared by a listener and the connections
+// of a test.
+type tcpEndpoint struct {
+	listener *net.TCPListener
+	dialer   net.Dialer
+	addr     *net.UDPAddr
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (c *Client) newTCPEndpoint(ip net.IP) (*tcpEndpoint, error) {
+	control := func(network, address string, rc syscall.RawConn) error {
+		if err := c.control(network, address, rc); err != nil {
+			return err
+		}
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = setReusePort(fd)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+	lc := net.ListenConfig{Control: control}
+	l, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	laddr := l.Addr().(*net.TCPAddr)
+	return &tcpEndpoint{
+		listener: l.(*net.TCPListener),
+		dialer: net.Dialer{
+			LocalAddr: laddr,
+			Control:   control,
+			Timeout:   tcpTransactionTimeoutMs * time.Millisecond,
+		},
+		addr: toUDPAddr(laddr),
+	}, nil
+}
+
+func (ep *tcpEndpoint) keep(conn net.Conn) {
+	ep.mu.Lock()
+	ep.conns = append(ep.conns, conn)
+	ep.mu.Unlock()
+}
+
+func (ep *tcpEndpoint) dial(dst *net.UDPAddr) (net.Conn, error) {
+	conn, err := ep.dialer.Dial("tcp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	ep.keep(conn)
+	return conn, nil
+}
+
+// binding runs a transaction over a new connection to dst, which is kept
+// open so that its mapping lives on.
+func (ep *tcpEndpoint) binding(dst *net.UDPAddr, rqst *packet) (*packet, net.Conn, error) {
+	conn, err := ep.dial(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(rqst.serialize()); err != nil {
+		return nil, nil, err
+	}
+	reply, err := readStreamResponse(conn, rqst.transID, tcpTransactionTimeoutMs*time.Millisecond)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply == nil {
+		return nil, nil, errors.New("the STUN server had NO answer:" + dst.String())
+	}
+	return reply, conn, nil
+}
+
+// connectBack asks the server, over the primary connection, to connect back
+// from the address CHANGE-REQUEST selects, and tells whether the inbound
+// connection got through.
+func (ep *tcpEndpoint) connectBack(primary net.Conn, changeIP, changePort bool) (bool, error) {
+	rqst := buildBindingRequestRFC5389(changeIP, changePort)
+	timeout := tcpConnectBackTimeoutMs * time.Millisecond
+
+	type outcome struct {
+		inbound bool
+		reply   *packet
+		err     error
+	}
+	done := make(chan outcome, 2)
+	_ = ep.listener.SetDeadline(time.Now().Add(timeout))
+	go func() {
+		for {
+			conn, err := ep.listener.Accept()
+			if err != nil {
+				done <- outcome{inbound: true, err: err}
+				return
+			}
+			ep.keep(conn)
+			if reply, _ := readStreamResponse(conn, rqst.transID, timeout); reply != nil {
+				done <- outcome{inbound: true, reply: reply}
+				return
+			}
+		}
+	}()
+	if _, err := primary.Write(rqst.serialize()); err != nil {
+		_ = ep.listener.SetDeadline(time.Now())
+		<-done
+		return false, err
+	}
+	go func() {
+		reply, err := readStreamResponse(primary, rqst.transID, timeout)
+		done <- outcome{reply: reply, err: err}
+	}()
+
+	first := <-done
+	// stop the other wait, again until it stops as an accepted connection
+	// may set its own deadline meanwhile
+	for stopped := false; !stopped; {
+		ep.interrupt()
+		select {
+		case <-done:
+			stopped = true
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	switch {
+	case first.inbound && first.reply != nil:
+		return true, nil
+	case first.reply != nil && first.reply.types == msgTypeBindingErrorResponse:
+		return false, errConnectBackUnsupported
+	case first.reply != nil:
+		return false, nil
+	case first.inbound:
+		// the listener timed out, the server did not answer at all
+		return false, errConnectBackUnsupported
+	}
+	if nerr, ok := first.err.(net.Error); first.err != nil && !(ok && nerr.Timeout()) {
+		return false, first.err
+	}
+	return false, errConnectBackUnsupported
+}
+
+// interrupt wakes up the accept and reads in progress on the endpoint.
+func (ep *tcpEndpoint) interrupt() {
+	_ = ep.listener.SetDeadline(time.Now())
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for _, conn := range ep.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (ep *tcpEndpoint) close() {
+	ep.listener.Close()
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for _, conn := range ep.conns {
+		conn.Close()
+	}
+}
+
+// readStreamResponse reads the response to transID from a connection, nil
+// on timeout.
+func readStreamResponse(conn net.Conn, transID []byte, timeout time.Duration) (*packet, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		data, err := readMessage(conn)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		p, err := parsePackage(data)
+		if err != nil {
+			return nil, err
+		}
+		if !isResponseType(p.types) || !bytes.Equal(p.transID, transID) {
+			continue
+		}
+		p.orgHost = toUDPAddr(conn.RemoteAddr())
+		return p, nil
+	}
+}
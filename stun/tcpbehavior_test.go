@@ -0,0 +1,205 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// tcpBehaviorServer is an RFC 5780 server over TCP on 127.0.0.1 and
+// 127.0.0.2, which connects back on CHANGE-REQUEST.
+type tcpBehaviorServer struct {
+	// primary, primary IP and alternate port, alternate IP and primary
+	// port, alternate address
+	addrs [4]*net.TCPAddr
+	// mapped is the address reported by listener i to a source
+	mapped func(i int, from *net.UDPAddr) *net.UDPAddr
+	// connectBack tells whether the NAT lets the connection back from the
+	// changed address in, nil rejects CHANGE-REQUEST
+	connectBack func(changeIP, changePort bool) bool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func reusePortControl(network, address string, rc syscall.RawConn) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = setReusePort(fd)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func newTCPBehaviorServer(t *testing.T) *tcpBehaviorServer {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP behavior discovery runs on Linux only")
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	listen := func(ip string, port int) net.Listener {
+		l, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			return nil
+		}
+		return l
+	}
+	// the same two ports on both IPs
+	var listeners []net.Listener
+	for len(listeners) < 4 {
+		primary := listen("127.0.0.1", 0)
+		if primary == nil {
+			t.Skip("can not listen on loopback")
+		}
+		alternate := listen("127.0.0.2", primary.Addr().(*net.TCPAddr).Port)
+		if alternate == nil {
+			primary.Close()
+			continue
+		}
+		listeners = append(listeners, primary, alternate)
+	}
+	s := &tcpBehaviorServer{}
+	// listeners holds the first port on both IPs, then the second one
+	order := []net.Listener{listeners[0], listeners[2], listeners[1], listeners[3]}
+	for i, l := range order {
+		s.addrs[i] = l.Addr().(*net.TCPAddr)
+		go s.serve(i, l)
+	}
+	t.Cleanup(func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+	})
+	return s
+}
+
+func (s *tcpBehaviorServer) keep(conn net.Conn) {
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *tcpBehaviorServer) serve(i int, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.keep(conn)
+		go s.serveConn(i, conn)
+	}
+}
+
+func (s *tcpBehaviorServer) serveConn(i int, conn net.Conn) {
+	from := toUDPAddr(conn.RemoteAddr())
+	for {
+		data, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		req, err := parsePackage(data)
+		if err != nil || req.types != msgTypeBindingRequest {
+			continue
+		}
+		resp, _ := newPacket()
+		resp.types = msgTypeBindingResponse
+		resp.transID = req.transID
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, s.mapped(i, from), req.transID))
+		resp.addAttribute(*newAddrAttribute(attributeOtherAddress, toUDPAddr(s.addrs[3])))
+
+		change := req.findAttr(attributeChangeRequest)
+		if change == nil {
+			_, _ = conn.Write(resp.serialize())
+			continue
+		}
+		if s.connectBack == nil {
+			reject, _ := newPacket()
+			reject.types = msgTypeBindingErrorResponse
+			reject.transID = req.transID
+			reject.addAttribute(*newErrorCodeAttribute(420, "Unknown Attribute"))
+			_, _ = conn.Write(reject.serialize())
+			continue
+		}
+		changeIP, changePort := change.value[3]&0x04 != 0, change.value[3]&0x02 != 0
+		if s.connectBack(changeIP, changePort) {
+			target := i
+			if changeIP {
+				target ^= 2
+			}
+			if changePort {
+				target ^= 1
+			}
+			dialer := net.Dialer{LocalAddr: s.addrs[target], Control: reusePortControl}
+			if back, err := dialer.Dial("tcp", from.String()); err == nil {
+				s.keep(back)
+				_, _ = back.Write(resp.serialize())
+				continue
+			}
+		}
+		_, _ = conn.Write(resp.serialize())
+	}
+}
+
+func TestDiscoverTCPBehavior(t *testing.T) {
+	always := func(changeIP, changePort bool) bool { return true }
+	never := func(changeIP, changePort bool) bool { return false }
+	cases := []struct {
+		name        string
+		mapped      func(i int, from *net.UDPAddr) *net.UDPAddr
+		connectBack func(changeIP, changePort bool) bool
+		mapping     MappingBehavior
+		filtering   FilteringBehavior
+		simOpen     bool
+	}{
+		// a self-connect without NAT is no simultaneous open through one
+		{"no NAT", func(i int, from *net.UDPAddr) *net.UDPAddr {
+			return from
+		}, always, MappingEndpointIndependent, FilteringEndpointIndependent, false},
+		// the test NAT does not hairpin
+		{"endpoint independent", func(i int, from *net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: testNATIP, Port: from.Port}
+		}, always, MappingEndpointIndependent, FilteringEndpointIndependent, false},
+		{"address dependent", func(i int, from *net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: testNATIP, Port: from.Port + i/2}
+		}, func(changeIP, changePort bool) bool { return !changeIP }, MappingAddressDependent, FilteringAddressDependent, false},
+		{"address and port dependent", func(i int, from *net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: testNATIP, Port: from.Port + i}
+		}, never, MappingAddressAndPortDependent, FilteringAddressAndPortDependent, false},
+		{"no connect back", func(i int, from *net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: testNATIP, Port: from.Port}
+		}, nil, MappingEndpointIndependent, FilteringUnknown, false},
+	}
+	for _, tc := range cases {
+		srv := newTCPBehaviorServer(t)
+		srv.mapped, srv.connectBack = tc.mapped, tc.connectBack
+		client := NewClient(WithLocalIP(net.IPv4(127, 0, 0, 1)))
+		b, err := client.DiscoverTCPBehavior(srv.addrs[0].String())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if b.Mapping != tc.mapping || b.Filtering != tc.filtering || b.SimultaneousOpen != tc.simOpen {
+			t.Errorf("%s: %v", tc.name, b)
+		}
+	}
+}
+
+func TestTCPBehaviorString(t *testing.T) {
+	b := &TCPBehavior{Filtering: FilteringUnknown}
+	if !strings.Contains(b.String(), "does not connect back") {
+		t.Errorf("unknown filtering not explained: %v", b)
+	}
+	b.Filtering = FilteringEndpointIndependent
+	if strings.Contains(b.String(), "does not connect back") {
+		t.Errorf("known filtering explained: %v", b)
+	}
+}
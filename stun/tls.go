@@ -0,0 +1,131 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+// WithTLSConfig sets the base TLS configuration of the TLS transport. The
+// other TLS options are applied on top of a copy of it, whatever the order
+// of the options.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithRootCAs sets the certificate authorities used to verify the server.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *Client) {
+		c.tlsRootCAs = pool
+	}
+}
+
+// WithServerName overrides the SNI and the name verified in the server
+// certificate, which default to the host of the server address.
+func WithServerName(name string) ClientOption {
+	return func(c *Client) {
+		c.tlsServerName = name
+	}
+}
+
+// WithClientCertificates sets the certificates presented to the server.
+func WithClientCertificates(certs ...tls.Certificate) ClientOption {
+	return func(c *Client) {
+		c.tlsCerts = certs
+	}
+}
+
+// WithPinnedCertificate pins the server certificate by the SHA-256 digest
+// of its DER encoding. The pin is checked on top of the chain verification,
+// combine it with InsecureSkipVerify in WithTLSConfig to trust a self-signed
+// server by its pin only. Several pins may be given.
+func WithPinnedCertificate(sha256Digest []byte) ClientOption {
+	return func(c *Client) {
+		c.tlsPins = append(c.tlsPins, sha256Digest)
+	}
+}
+
+// clientTLSConfig builds the configuration of one TLS connection to host,
+// the other TLS options on top of the base one, whatever their order.
+func (c *Client) clientTLSConfig(host string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	}
+	if c.tlsRootCAs != nil {
+		cfg.RootCAs = c.tlsRootCAs
+	}
+	if c.tlsServerName != "" {
+		cfg.ServerName = c.tlsServerName
+	}
+	if c.tlsCerts != nil {
+		cfg.Certificates = c.tlsCerts
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if len(c.tlsPins) > 0 {
+		pins := c.tlsPins
+		verify := cfg.VerifyPeerCertificate
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			return checkPins(rawCerts, pins)
+		}
+	}
+	return cfg
+}
+
+// checkPins verifies the leaf certificate against the pinned digests.
+func checkPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	digest := sha256.Sum256(rawCerts[0])
+	for _, pin := range pins {
+		if bytes.Equal(pin, digest[:]) {
+			return nil
+		}
+	}
+	return errors.New("server certificate does not match the pinned certificate")
+}
+
+// tlsHandshake wraps a dialed connection into a TLS client connection.
+func (c *Client) tlsHandshake(conn net.Conn) (net.Conn, error) {
+	host := c.srvHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	tconn := tls.Client(conn, c.clientTLSConfig(host))
+	_ = tconn.SetDeadline(time.Now().Add(tcpTransactionTimeoutMs * time.Millisecond))
+	if err := tconn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = tconn.SetDeadline(time.Time{})
+	return tconn, nil
+}
@@ -0,0 +1,87 @@
+package stun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-stun test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestBindingTLS(t *testing.T) {
+	srv := newTestServer(t)
+	cert := newTestCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Skip("can not listen on loopback:", err)
+	}
+	defer l.Close()
+	go srv.serveStream(l)
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	pin := sha256.Sum256(cert.Certificate[0])
+	uri := "stuns:" + l.Addr().String()
+
+	client := NewClient(WithRootCAs(pool), WithPinnedCertificate(pin[:]))
+	defer client.Close()
+	mapped, err := client.Binding(uri)
+	if err != nil {
+		t.Fatalf("binding over TLS error: %v", err)
+	}
+	if mapped.String() != client.LocalAddr().String() {
+		t.Errorf("mapped address %v != local address %v", mapped, client.LocalAddr())
+	}
+	// the stuns: URI switches that call only, a plain address is UDP again
+	if _, err := client.Binding(srv.udpAddr()); err != nil {
+		t.Errorf("binding over UDP after TLS error: %v", err)
+	}
+
+	// the base configuration does not undo the options applied before it
+	client = NewClient(WithRootCAs(pool), WithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	defer client.Close()
+	if _, err := client.Binding(uri); err != nil {
+		t.Errorf("binding with the root CAs set before the base config error: %v", err)
+	}
+
+	client = NewClient(WithTLSConfig(&tls.Config{InsecureSkipVerify: true}), WithPinnedCertificate(make([]byte, 32)))
+	defer client.Close()
+	if _, err := client.Binding(uri); err == nil {
+		t.Errorf("binding with a mismatched pin should fail")
+	}
+
+	client = NewClient(WithTransport(TransportTLS))
+	defer client.Close()
+	if _, err := client.Binding(l.Addr().String()); err == nil {
+		t.Errorf("binding with an untrusted certificate should fail")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Transport is the protocol carrying the STUN messages of a Client.
+type Transport int
+
+// Transports.
+const (
+	TransportUDP Transport = iota
+	TransportTCP
+	TransportTLS
+)
+
+var transportDescription = map[Transport]string{
+	TransportUDP: "udp",
+	TransportTCP: "tcp",
+	TransportTLS: "tls",
+}
+
+func (t Transport) String() string {
+	if s, ok := transportDescription[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// RFC 5389: reliable transports use a single transaction timeout (Ti) of
+// 39.5 seconds, the request is never retransmitted.
+const tcpTransactionTimeoutMs = 39500
+
+// WithTransport selects the transport of the client, UDP by default.
+func WithTransport(t Transport) ClientOption {
+	return func(c *Client) {
+		c.transport = t
+		c.transportOpt = t
+	}
+}
+
+// streamSendPackageWaitReply runs one transaction over a stream connection
+// to srvAddr. The connection is kept and reused by later transactions.
+func (c *Client) streamSendPackageWaitReply(rqst *packet, srvAddr net.Addr, fchk chkfun) (*packet, error) {
+	conn, err := c.streamConn(srvAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(rqst.serialize()); err != nil {
+		c.dropStream(srvAddr)
+		return nil, err
+	}
+	err = conn.SetReadDeadline(time.Now().Add(tcpTransactionTimeoutMs * time.Millisecond))
+	if err != nil {
+		c.dropStream(srvAddr)
+		return nil, err
+	}
+
+	for {
+		data, err := readMessage(conn)
+		if err != nil {
+			// a message read in part breaks the framing of the stream, it
+			// is not reused after a timeout either
+			c.dropStream(srvAddr)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		p, err := parsePackage(data)
+		if err != nil {
+			c.dropStream(srvAddr)
+			return nil, err
+		}
+		if !bytes.Equal(rqst.transID, p.transID) {
+			continue
+		}
+		p.orgHost = toUDPAddr(conn.RemoteAddr())
+		if !fchk(c, p) {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// streamConn returns the cached connection to srvAddr, dialing a new one
+// when there is none yet.
+func (c *Client) streamConn(srvAddr net.Addr) (net.Conn, error) {
+	key := srvAddr.String()
+	if conn, ok := c.streams[key]; ok {
+		return conn, nil
+	}
+	conn, err := c.dialStream(srvAddr)
+	if err != nil {
+		return nil, err
+	}
+	if c.transport == TransportTLS {
+		if conn, err = c.tlsHandshake(conn); err != nil {
+			return nil, err
+		}
+	}
+	if c.streams == nil {
+		c.streams = make(map[string]net.Conn)
+	}
+	c.streams[key] = conn
+	return conn, nil
+}
+
+func (c *Client) dropStream(srvAddr net.Addr) {
+	key := srvAddr.String()
+	if conn, ok := c.streams[key]; ok {
+		_ = conn.Close()
+		delete(c.streams, key)
+	}
+}
+
+// dialStream opens a TCP connection to srvAddr from the configured local
+// address, port range and interface.
+func (c *Client) dialStream(srvAddr net.Addr) (net.Conn, error) {
+	raddr := toUDPAddr(srvAddr)
+	var lip net.IP
+	if c.localIP != nil {
+		lip = c.localIP
+	} else if c.ifName != "" {
+		ip, err := interfaceIP(c.ifName, raddr.IP.To4() == nil)
+		if err != nil {
+			return nil, err
+		}
+		lip = ip
+	}
+
+	dialer := net.Dialer{
+		Timeout: tcpTransactionTimeoutMs * time.Millisecond,
+		Control: c.control,
+	}
+	if c.localPortMin <= 0 {
+		if lip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: lip}
+		}
+		return dialer.Dial("tcp", raddr.String())
+	}
+
+	var lastErr error
+	for port := c.localPortMin; port <= c.localPortMax; port++ {
+		dialer.LocalAddr = &net.TCPAddr{IP: lip, Port: port}
+		conn, err := dialer.Dial("tcp", raddr.String())
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("empty local port range")
+	}
+	return nil, lastErr
+}
+
+// readMessage reads one STUN message framed by the length in its header.
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[2:4])
+	data := make([]byte, 20+int(length))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[20:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// toUDPAddr converts any IP based net.Addr to a *net.UDPAddr, which is the
+// address type used all over the client.
+func toUDPAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// Close releases the connections kept by the client.
+func (c *Client) Close() error {
+	for key, conn := range c.streams {
+		_ = conn.Close()
+		delete(c.streams, key)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	p1 := buildBindingRequest(false, false)
+	p2 := buildBindingRequest(true, true)
+	stream := bytes.NewBuffer(append(p1.serialize(), p2.serialize()...))
+
+	for _, want := range [][]byte{p1.serialize(), p2.serialize()} {
+		got, err := readMessage(stream)
+		if err != nil {
+			t.Fatalf("read framed message error: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("framed message mismatch: %x != %x", got, want)
+		}
+	}
+	if _, err := readMessage(stream); err == nil {
+		t.Errorf("read from drained stream should fail")
+	}
+}
+
+func TestBindingTCP(t *testing.T) {
+	srv := newTestServer(t)
+	client := NewClient(WithTransport(TransportTCP))
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		mapped, err := client.Binding(srv.tcpAddr())
+		if err != nil {
+			t.Fatalf("binding over TCP error: %v", err)
+		}
+		if mapped.String() != client.LocalAddr().String() {
+			t.Errorf("mapped address %v != local address %v", mapped, client.LocalAddr())
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.accepted != 1 {
+		t.Errorf("connection not reused, %d connections accepted", srv.accepted)
+	}
+}
+
+func TestBindingTCPXorMappedOnly(t *testing.T) {
+	srv := newTestServer(t)
+	// an RFC 5389 server, without the MAPPED-ADDRESS of RFC 3489
+	srv.setHandler(func(req *packet, from *net.UDPAddr) *packet {
+		if req.types != msgTypeBindingRequest {
+			return nil
+		}
+		resp, _ := newPacket()
+		resp.types = msgTypeBindingResponse
+		resp.transID = req.transID
+		resp.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, from, req.transID))
+		return resp
+	})
+	client := NewClient(WithTransport(TransportTCP))
+	defer client.Close()
+
+	mapped, err := client.Binding(srv.tcpAddr())
+	if err != nil {
+		t.Fatalf("binding over TCP error: %v", err)
+	}
+	if mapped.String() != client.LocalAddr().String() {
+		t.Errorf("mapped address %v != local address %v", mapped, client.LocalAddr())
+	}
+}
+
+func TestBindingUDP(t *testing.T) {
+	srv := newTestServer(t)
+	client := NewClient()
+	mapped, err := client.Binding(srv.udpAddr())
+	if err != nil {
+		t.Fatalf("binding over UDP error: %v", err)
+	}
+	if mapped.Port != client.LocalAddr().Port {
+		t.Errorf("mapped port %d != local port %d", mapped.Port, client.LocalAddr().Port)
+	}
+}
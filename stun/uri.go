@@ -0,0 +1,121 @@
+/*
+** Copyright 2021 huskerTang <huskertang@gmail.com>
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+**      http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+**/
+package stun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// URI schemes, RFC 7064.
+const (
+	SchemeSTUN  = "stun"
+	SchemeSTUNS = "stuns"
+)
+
+// Default ports of the STUN schemes.
+const (
+	DefaultPort    = 3478
+	DefaultTLSPort = 5349
+)
+
+// URI is a parsed stun: or stuns: URI.
+//
+//	stunURI = scheme ":" host [ ":" port ]
+type URI struct {
+	Scheme string
+	Host   string
+	Port   int
+}
+
+// ParseURI parses a stun: or stuns: URI, filling in the default port of
+// the scheme when it is omitted.
+func ParseURI(s string) (*URI, error) {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return nil, errors.New("missing STUN URI scheme:" + s)
+	}
+	u := &URI{Scheme: strings.ToLower(s[:i])}
+	switch u.Scheme {
+	case SchemeSTUN:
+		u.Port = DefaultPort
+	case SchemeSTUNS:
+		u.Port = DefaultTLSPort
+	default:
+		return nil, errors.New("unsupported STUN URI scheme:" + s)
+	}
+
+	hostport := s[i+1:]
+	if strings.HasPrefix(hostport, "//") || strings.ContainsAny(hostport, "/?#@") {
+		return nil, errors.New("invalid STUN URI:" + s)
+	}
+	host := hostport
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.Index(hostport, "]")
+		if end < 0 {
+			return nil, errors.New("invalid STUN URI:" + s)
+		}
+		host = hostport[1:end]
+		hostport = hostport[end+1:]
+		if hostport != "" && !strings.HasPrefix(hostport, ":") {
+			return nil, errors.New("invalid STUN URI:" + s)
+		}
+		hostport = strings.TrimPrefix(hostport, ":")
+	} else if j := strings.LastIndex(hostport, ":"); j >= 0 {
+		host = hostport[:j]
+		hostport = hostport[j+1:]
+	} else {
+		hostport = ""
+	}
+	if host == "" {
+		return nil, errors.New("missing host in STUN URI:" + s)
+	}
+	if hostport != "" {
+		port, err := strconv.Atoi(hostport)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errors.New("invalid port in STUN URI:" + s)
+		}
+		u.Port = port
+	}
+	u.Host = host
+	return u, nil
+}
+
+// Addr returns the host:port of the URI.
+func (u *URI) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// Secure reports whether the URI requires a TLS transport.
+func (u *URI) Secure() bool {
+	return u.Scheme == SchemeSTUNS
+}
+
+func (u *URI) String() string {
+	host := u.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return u.Scheme + ":" + host + ":" + strconv.Itoa(u.Port)
+}
+
+// isURI tells a stun: or stuns: URI from a plain host:port address.
+func isURI(s string) bool {
+	lower := strings.ToLower(s)
+	return strings.HasPrefix(lower, SchemeSTUN+":") || strings.HasPrefix(lower, SchemeSTUNS+":")
+}
@@ -0,0 +1,40 @@
+package stun
+
+import (
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	cases := map[string]string{
+		"stun:example.org":        "stun:example.org:3478",
+		"stuns:example.org":       "stuns:example.org:5349",
+		"STUN:example.org:1234":   "stun:example.org:1234",
+		"stun:192.0.2.1:3479":     "stun:192.0.2.1:3479",
+		"stuns:[2001:db8::1]":     "stuns:[2001:db8::1]:5349",
+		"stuns:[2001:db8::1]:443": "stuns:[2001:db8::1]:443",
+	}
+	for in, want := range cases {
+		u, err := ParseURI(in)
+		if err != nil {
+			t.Errorf("parse %s error: %v", in, err)
+			continue
+		}
+		if u.String() != want {
+			t.Errorf("parse %s: %s != %s", in, u.String(), want)
+		}
+	}
+
+	for _, in := range []string{
+		"example.org:3478",
+		"turn:example.org",
+		"stun:",
+		"stun://example.org",
+		"stun:example.org:99999",
+		"stun:[2001:db8::1",
+		"stun:example.org?transport=udp",
+	} {
+		if _, err := ParseURI(in); err == nil {
+			t.Errorf("parse %s should fail", in)
+		}
+	}
+}
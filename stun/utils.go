@@ -17,7 +17,8 @@ func align(n uint16) uint16 {
 	return (n + 3) & 0xfffc
 }
 
-// isLocalAddress check if localRemote is a local address.
+// isLocalAddress check if localRemote is an address of this host, that is
+// the local address of the socket or the address of one of the interfaces.
 func isLocalAddress(local, localRemote string) bool {
 	// Resolve the IP returned by the STUN server first.
 	localRemoteAddr, err := net.ResolveUDPAddr("udp", localRemote)
@@ -27,10 +28,11 @@ func isLocalAddress(local, localRemote string) bool {
 	// Try comparing with the local address on the socket first, but only if
 	// it's actually specified.
 	addr, err := net.ResolveUDPAddr("udp", local)
-	if err == nil && addr.IP != nil && !addr.IP.IsUnspecified() {
-		return addr.IP.Equal(localRemoteAddr.IP)
+	if err == nil && addr.IP != nil && !addr.IP.IsUnspecified() && addr.IP.Equal(localRemoteAddr.IP) {
+		return true
 	}
-	// Fallback to checking IPs of all interfaces
+	// Fallback to checking IPs of all interfaces, a host with several
+	// addresses may be reported any of them
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return false